@@ -0,0 +1,390 @@
+package liberty
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.scot/liberty/env"
+	"golang.scot/liberty/middleware"
+)
+
+// key types for ACME account and certificate keys
+const (
+	ECDSAKey = "ecdsa"
+	RSAKey   = "rsa"
+)
+
+// ACME challenge types which can be allowed for a vhost
+const (
+	HTTP01    = "http-01"
+	TLSALPN01 = "tls-alpn-01"
+)
+
+// the name of the account key in the cache, as autocert itself would use
+const acmeAccountKey = "acme_account+key"
+
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+var errChallengeNotAllowed = errors.New("ACME challenge type not allowed for server name")
+
+// ACME configures certificates from an RFC 8555 ACME CA such as Let's Encrypt.
+// The DirectoryURL defaults to the Let's Encrypt v2 staging directory outside
+// of production. CACert is a PEM bundle to trust for the directory, which is
+// only needed for a local test CA such as Pebble. The account key is kept in the
+// CacheDir along with the certificates, so the same account is used across
+// restarts. Certificates are renewed RenewBefore they expire.
+//
+// Challenges are the challenge types allowed for vhosts which don't choose
+// their own, by default both http-01, answered on port 80, and tls-alpn-01,
+// answered on port 443, so a certificate can be issued with only one of them
+// open.
+type ACME struct {
+	DirectoryURL string        `yaml:"directoryURL"`
+	CACert       string        `yaml:"caCert"`
+	Email        string        `yaml:"email"`
+	CacheDir     string        `yaml:"cacheDir"`
+	KeyType      string        `yaml:"keyType"`
+	RenewBefore  time.Duration `yaml:"renewBefore"`
+	Challenges   []string      `yaml:"challenges, flow"`
+}
+
+// set defaults for anything left out of the config, the cache dir and email
+// may still come from the environment as they used to
+func (a *ACME) normalise() {
+	if a.DirectoryURL == "" {
+		a.DirectoryURL = letsEncryptUrl
+		if env.Get() != env.Prod {
+			a.DirectoryURL = letsEncryptSandboxUrl
+		}
+	}
+	if a.CacheDir == "" {
+		a.CacheDir = os.Getenv("ACME_CACHE")
+	}
+	if a.Email == "" {
+		a.Email = os.Getenv("ACME_EMAIL")
+	}
+	if a.KeyType == "" {
+		a.KeyType = ECDSAKey
+	}
+	if a.RenewBefore <= 0 {
+		a.RenewBefore = 30 * 24 * time.Hour
+	}
+	if len(a.Challenges) == 0 {
+		a.Challenges = []string{HTTP01, TLSALPN01}
+	}
+}
+
+// newAcmeManager creates the autocert manager shared by all servers, issuing
+// certificates for the domains given with the challenges they allow.
+func newAcmeManager(conf *ACME, domains []string, challenges *challengePolicy) (*autocert.Manager, error) {
+	if conf.KeyType != ECDSAKey && conf.KeyType != RSAKey {
+		return nil, fmt.Errorf("unknown ACME key type '%s'", conf.KeyType)
+	}
+	if err := validChallenges(conf.Challenges); err != nil {
+		return nil, err
+	}
+
+	var cache autocert.Cache
+	if conf.CacheDir != "" {
+		cache = autocert.DirCache(conf.CacheDir)
+	}
+
+	key, err := accountKey(cache, conf.KeyType)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := newAcmeClient(conf, key, challenges)
+	if err != nil {
+		return nil, err
+	}
+
+	return &autocert.Manager{
+		Client:      client,
+		Cache:       cache,
+		Email:       conf.Email,
+		Prompt:      autocert.AcceptTOS,
+		HostPolicy:  autocert.HostWhitelist(domains...),
+		RenewBefore: conf.RenewBefore,
+		ForceRSA:    conf.KeyType == RSAKey,
+	}, nil
+}
+
+// newAcmeClient creates the client for the directory, which only offers
+// autocert the challenges the policy allows
+func newAcmeClient(conf *ACME, key crypto.Signer, challenges *challengePolicy) (*acme.Client, error) {
+	client := &acme.Client{Key: key, DirectoryURL: conf.DirectoryURL}
+
+	tr := http.DefaultTransport
+	if conf.CACert != "" {
+		pem, err := ioutil.ReadFile(conf.CACert)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in '%s'", conf.CACert)
+		}
+		tr = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: roots},
+		}
+	}
+
+	if challenges != nil {
+		tr = challengeFilter{RoundTripper: tr, policy: challenges}
+	}
+	if tr != http.DefaultTransport {
+		client.HTTPClient = &http.Client{Transport: tr}
+	}
+
+	return client, nil
+}
+
+// challengeFilter drops the challenges a host doesn't allow from the
+// authorizations sent by the CA. Autocert tries every challenge type it
+// supports in turn, so it only ever sees those it may use rather than using up
+// an authorization on one which would be refused.
+type challengeFilter struct {
+	http.RoundTripper
+	policy *challengePolicy
+}
+
+func (cf challengeFilter) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp, err := cf.RoundTripper.RoundTrip(r)
+	if err != nil || resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		return resp, err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	body = cf.filter(body)
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Del("Content-Length")
+
+	return resp, nil
+}
+
+// filter an authorization, anything else is returned as it is
+func (cf challengeFilter) filter(body []byte) []byte {
+	var authz map[string]json.RawMessage
+	if err := json.Unmarshal(body, &authz); err != nil {
+		return body
+	}
+	var id struct {
+		Type  string `json:"type"`
+		Value string `json:"value"`
+	}
+	var challenges []json.RawMessage
+	if authz["identifier"] == nil || authz["challenges"] == nil ||
+		json.Unmarshal(authz["identifier"], &id) != nil || json.Unmarshal(authz["challenges"], &challenges) != nil {
+		return body
+	}
+
+	allowed := make([]json.RawMessage, 0, len(challenges))
+	for _, c := range challenges {
+		var chal struct {
+			Type string `json:"type"`
+		}
+		if json.Unmarshal(c, &chal) == nil && cf.policy.allows(id.Value, chal.Type) {
+			allowed = append(allowed, c)
+		}
+	}
+	if len(allowed) == len(challenges) {
+		return body
+	}
+
+	authz["challenges"], _ = json.Marshal(allowed)
+	filtered, err := json.Marshal(authz)
+	if err != nil {
+		return body
+	}
+	return filtered
+}
+
+// accountKey loads the ACME account key from the cache, or generates one and
+// stores it there. Without a cache a new key is used every time.
+func accountKey(cache autocert.Cache, keyType string) (crypto.Signer, error) {
+	ctx := context.Background()
+
+	if cache != nil {
+		data, err := cache.Get(ctx, acmeAccountKey)
+		switch {
+		case err == nil:
+			return parseAccountKey(data)
+		case err != autocert.ErrCacheMiss:
+			return nil, err
+		}
+	}
+
+	key, data, err := generateAccountKey(keyType)
+	if err != nil {
+		return nil, err
+	}
+
+	if cache != nil {
+		if err := cache.Put(ctx, acmeAccountKey, data); err != nil {
+			return nil, err
+		}
+		log.Println("created a new ACME account key")
+	}
+
+	return key, nil
+}
+
+func generateAccountKey(keyType string) (crypto.Signer, []byte, error) {
+	if keyType == RSAKey {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, nil, err
+		}
+		block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+		return key, pem.EncodeToMemory(block), nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	block := &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	return key, pem.EncodeToMemory(block), nil
+}
+
+func parseAccountKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("cannot decode the cached ACME account key")
+	}
+
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+
+	return nil, fmt.Errorf("unknown ACME account key type '%s'", block.Type)
+}
+
+func validChallenges(challenges []string) error {
+	for _, c := range challenges {
+		if c != HTTP01 && c != TLSALPN01 {
+			return fmt.Errorf("unknown ACME challenge type '%s'", c)
+		}
+	}
+	return nil
+}
+
+// challengePolicy records the ACME challenge types allowed for each vhost
+type challengePolicy struct {
+	defaults []string
+	hosts    map[string][]string
+}
+
+func newChallengePolicy(defaults []string) *challengePolicy {
+	return &challengePolicy{defaults: defaults, hosts: make(map[string][]string)}
+}
+
+// add the challenges chosen by a proxy entry for its hosts, a host served by
+// several entries allows the challenges any of them choose
+func (cp *challengePolicy) add(hosts []string, challenges []string) {
+	if len(challenges) == 0 {
+		return
+	}
+	for _, host := range hosts {
+		host = strings.ToLower(host)
+		cp.hosts[host] = append(cp.hosts[host], challenges...)
+	}
+}
+
+// allows reports whether the challenge may be answered for the host, without
+// a policy every challenge is allowed
+func (cp *challengePolicy) allows(host, challenge string) bool {
+	if cp == nil {
+		return true
+	}
+
+	challenges, ok := cp.hosts[strings.ToLower(host)]
+	if !ok {
+		challenges = cp.defaults
+	}
+	for _, c := range challenges {
+		if c == challenge {
+			return true
+		}
+	}
+
+	return false
+}
+
+// any reports whether the challenge is allowed for at least one host, hosts
+// without challenges of their own follow the defaults
+func (cp *challengePolicy) any(challenge string) bool {
+	if cp == nil {
+		return true
+	}
+
+	for _, c := range cp.defaults {
+		if c == challenge {
+			return true
+		}
+	}
+	for host := range cp.hosts {
+		if cp.allows(host, challenge) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// httpHandler is the handler for the plain HTTP servers, which answers http-01
+// challenges for the hosts allowing them and redirects everything else to
+// https. The manager is only asked to try http-01 if some host allows it.
+func (cp *challengePolicy) httpHandler(m *autocert.Manager) http.Handler {
+	if m == nil || !cp.any(HTTP01) {
+		return http.HandlerFunc(middleware.RedirectPerm)
+	}
+
+	h := m.HTTPHandler(nil)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			host = hostname
+		}
+		if strings.HasPrefix(r.URL.Path, acmeChallengePath) && !cp.allows(host, HTTP01) {
+			http.NotFound(w, r)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,238 @@
+package liberty
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestAccountKeyPersisted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "liberty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, keyType := range []string{ECDSAKey, RSAKey} {
+		cache := autocert.DirCache(dir + "/" + keyType)
+
+		first, err := accountKey(cache, keyType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := accountKey(cache, keyType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(first.Public(), second.Public()) {
+			t.Errorf("%s - account key was not reused from the cache", keyType)
+		}
+
+		switch first.(type) {
+		case *ecdsa.PrivateKey:
+			if keyType != ECDSAKey {
+				t.Errorf("%s - got an ECDSA key", keyType)
+			}
+		case *rsa.PrivateKey:
+			if keyType != RSAKey {
+				t.Errorf("%s - got an RSA key", keyType)
+			}
+		}
+	}
+}
+
+func TestAcmeManager(t *testing.T) {
+	conf := &ACME{KeyType: "dsa"}
+	conf.normalise()
+	if _, err := newAcmeManager(conf, nil, nil); err == nil {
+		t.Error("expected an error for an unknown key type")
+	}
+
+	conf = &ACME{Email: "admin@example.com"}
+	conf.normalise()
+	m, err := newAcmeManager(conf, []string{"example.com"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Email != conf.Email || m.RenewBefore != conf.RenewBefore {
+		t.Error("manager does not follow the config")
+	}
+	if err := m.HostPolicy(context.Background(), "example.com"); err != nil {
+		t.Error(err)
+	}
+	if err := m.HostPolicy(context.Background(), "other.org"); err == nil {
+		t.Error("expected the host policy to reject an unconfigured domain")
+	}
+}
+
+func TestChallengePolicy(t *testing.T) {
+	cp := newChallengePolicy([]string{HTTP01, TLSALPN01})
+	cp.add([]string{"alpn.example.com"}, []string{TLSALPN01})
+	cp.add([]string{"http.example.com", "Alias.example.com"}, []string{HTTP01})
+
+	tests := []struct {
+		host      string
+		challenge string
+		allowed   bool
+	}{
+		{"www.example.com", HTTP01, true},
+		{"www.example.com", TLSALPN01, true},
+		{"alpn.example.com", HTTP01, false},
+		{"alpn.example.com", TLSALPN01, true},
+		{"http.example.com", TLSALPN01, false},
+		{"alias.example.com", HTTP01, true},
+	}
+
+	for _, test := range tests {
+		if cp.allows(test.host, test.challenge) != test.allowed {
+			t.Errorf("%s %s - expected allowed to be %t", test.host, test.challenge, test.allowed)
+		}
+	}
+
+	alpnOnly := newChallengePolicy([]string{TLSALPN01})
+	if alpnOnly.any(HTTP01) {
+		t.Error("http-01 allowed when no host allows it")
+	}
+	alpnOnly.add([]string{"www.example.com"}, []string{HTTP01})
+	if !alpnOnly.any(HTTP01) {
+		t.Error("http-01 not allowed when a host allows it")
+	}
+}
+
+func TestChallengeHandler(t *testing.T) {
+	cp := newChallengePolicy([]string{HTTP01})
+	cp.add([]string{"alpn.example.com"}, []string{TLSALPN01})
+	h := cp.httpHandler(&autocert.Manager{HostPolicy: autocert.HostWhitelist("www.example.com", "alpn.example.com")})
+
+	tests := []struct {
+		url  string
+		code int
+	}{
+		{"http://alpn.example.com/.well-known/acme-challenge/token", http.StatusNotFound},
+		{"http://alpn.example.com/page", http.StatusFound},
+		{"http://www.example.com:80/page", http.StatusFound},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", test.url, nil))
+		if w.Code != test.code {
+			t.Errorf("%s - expected status %d, got %d", test.url, test.code, w.Code)
+		}
+	}
+
+	sel := &certSelector{acme: &autocert.Manager{}, challenges: cp}
+	hello := &tls.ClientHelloInfo{ServerName: "www.example.com", SupportedProtos: []string{acme.ALPNProto}}
+	if _, err := sel.GetCertificate(hello); err != errChallengeNotAllowed {
+		t.Errorf("expected tls-alpn-01 to be refused, got %v", err)
+	}
+}
+
+func TestChallengeFilter(t *testing.T) {
+	authz := `{"status":"pending","identifier":{"type":"dns","value":"http.example.com"},"challenges":[` +
+		`{"type":"tls-alpn-01","url":"https://ca/1","token":"a"},` +
+		`{"type":"http-01","url":"https://ca/2","token":"b"},` +
+		`{"type":"dns-01","url":"https://ca/3","token":"c"}]}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, authz)
+	}))
+	defer srv.Close()
+
+	cp := newChallengePolicy([]string{HTTP01, TLSALPN01})
+	cp.add([]string{"http.example.com"}, []string{HTTP01})
+	client := &http.Client{Transport: challengeFilter{RoundTripper: http.DefaultTransport, policy: cp}}
+
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var filtered struct {
+		Status     string `json:"status"`
+		Challenges []struct {
+			Type  string `json:"type"`
+			Token string `json:"token"`
+		} `json:"challenges"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&filtered); err != nil {
+		t.Fatal(err)
+	}
+	if filtered.Status != "pending" {
+		t.Errorf("authorization was not passed on whole, got status '%s'", filtered.Status)
+	}
+	if len(filtered.Challenges) != 1 || filtered.Challenges[0].Type != HTTP01 || filtered.Challenges[0].Token != "b" {
+		t.Errorf("expected only the http-01 challenge, got %+v", filtered.Challenges)
+	}
+}
+
+// TestPebble issues a certificate from a local Pebble, the RFC 8555 test CA,
+// and is skipped unless one is running. Pebble has to skip validation, as the
+// challenges can't reach the test, for example:
+//
+//	PEBBLE_VA_ALWAYS_VALID=1 pebble -config test/config/pebble-config.json
+//	LIBERTY_PEBBLE_URL=https://localhost:14000/dir \
+//	LIBERTY_PEBBLE_CA=$PEBBLE/test/certs/pebble.minica.pem go test -run Pebble
+func TestPebble(t *testing.T) {
+	directory, ca := os.Getenv("LIBERTY_PEBBLE_URL"), os.Getenv("LIBERTY_PEBBLE_CA")
+	if directory == "" || ca == "" {
+		t.Skip("LIBERTY_PEBBLE_URL and LIBERTY_PEBBLE_CA are not set")
+	}
+
+	dir, err := ioutil.TempDir("", "liberty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// only http-01 is allowed, which autocert would otherwise try after
+	// tls-alpn-01
+	conf := &ACME{DirectoryURL: directory, CACert: ca, CacheDir: dir, Email: "admin@example.com", Challenges: []string{HTTP01}}
+	conf.normalise()
+	m, err := newAcmeManager(conf, []string{"pebble.example.com"}, newChallengePolicy(conf.Challenges))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.HTTPHandler(nil)
+
+	// Pebble finalizes orders in the background and answers without the
+	// Location of the order, which the acme client needs to wait for it
+	hc := m.Client.HTTPClient
+	hc.Transport = pebbleFinalize{hc.Transport}
+
+	cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "pebble.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.Leaf.VerifyHostname("pebble.example.com"); err != nil {
+		t.Error(err)
+	}
+}
+
+type pebbleFinalize struct {
+	http.RoundTripper
+}
+
+func (pf pebbleFinalize) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp, err := pf.RoundTripper.RoundTrip(r)
+	if err == nil && strings.HasPrefix(r.URL.Path, "/finalize-order/") && resp.Header.Get("Location") == "" {
+		u := *r.URL
+		u.Path = "/my-order/" + strings.TrimPrefix(u.Path, "/finalize-order/")
+		resp.Header.Set("Location", u.String())
+	}
+	return resp, err
+}
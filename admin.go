@@ -0,0 +1,247 @@
+package liberty
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"golang.scot/liberty/middleware"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Admin configures the listener for the admin endpoints, these are kept apart
+// from the proxied vhosts and are protected with basic auth. The user name and
+// password are taken from LIBERTY_ADMIN_USER and LIBERTY_ADMIN_PASS, not those
+// of the proxied vhosts, and the listener isn't started without them.
+//
+// An Addr without a host, such as ":9000", listens on the loopback interface
+// only. With CertFile and KeyFile the endpoints are served over TLS, which
+// should be used for any other address so the credentials aren't sent in the
+// clear.
+type Admin struct {
+	Addr     string `yaml:"addr"`
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+}
+
+// admin credentials, kept apart from those of the proxied vhosts
+const (
+	adminUserEnv = "LIBERTY_ADMIN_USER"
+	adminPassEnv = "LIBERTY_ADMIN_PASS"
+)
+
+func (a *Admin) normalise() {
+	if host, port, err := net.SplitHostPort(a.Addr); err == nil && host == "" {
+		a.Addr = net.JoinHostPort("127.0.0.1", port)
+	}
+}
+
+func (a *Admin) validate() error {
+	if (a.CertFile == "") != (a.KeyFile == "") {
+		return errors.New("the admin listener needs both a certFile and a keyFile for TLS")
+	}
+	if os.Getenv(adminUserEnv) == "" || os.Getenv(adminPassEnv) == "" {
+		return fmt.Errorf("%s and %s must be set for the admin listener", adminUserEnv, adminPassEnv)
+	}
+	return nil
+}
+
+func (a *Admin) tls() bool {
+	return a.CertFile != ""
+}
+
+// Upstreams returns the state of the upstream pool for every configured proxy
+func (p *Proxy) Upstreams() []PoolStatus {
+	status := make([]PoolStatus, 0)
+	for _, proxy := range p.config.Proxies {
+		if proxy.pool != nil {
+			status = append(status, proxy.pool.status())
+		}
+	}
+
+	return status
+}
+
+var errEmptyCacheFilter = errors.New("a URL, prefix, host or tag is needed to purge the cache")
+
+// CacheFilter selects cached responses, every field which is set must match.
+// URL and Prefix are full URLs such as "https://example.com/path?query", the
+// scheme is ignored. Host matches with or without a port, and Tag matches the
+// surrogate keys the upstream gave the response.
+type CacheFilter struct {
+	URL    string
+	Prefix string
+	Host   string
+	Tag    string
+}
+
+func (f CacheFilter) empty() bool {
+	return f.URL == "" && f.Prefix == "" && f.Host == "" && f.Tag == ""
+}
+
+// cacheURL is a URL in the form the cache keys its entries, host then URI
+func cacheURL(rawurl string) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("cannot parse cache URL '%s' - a scheme and host are needed", rawurl)
+	}
+	return strings.ToLower(u.Host) + u.RequestURI(), nil
+}
+
+func (f CacheFilter) matcher() (func(*cacheEntry) bool, error) {
+	var exact, prefix string
+	var err error
+	if f.URL != "" {
+		if exact, err = cacheURL(f.URL); err != nil {
+			return nil, err
+		}
+	}
+	if f.Prefix != "" {
+		if prefix, err = cacheURL(f.Prefix); err != nil {
+			return nil, err
+		}
+	}
+	host := strings.ToLower(f.Host)
+
+	return func(e *cacheEntry) bool {
+		u := strings.TrimPrefix(e.key, "GET ")
+		if exact != "" && u != exact {
+			return false
+		}
+		if prefix != "" && !strings.HasPrefix(u, prefix) {
+			return false
+		}
+		if host != "" {
+			h := u
+			if i := strings.Index(u, "/"); i >= 0 {
+				h = u[:i]
+			}
+			hostname, _, err := net.SplitHostPort(h)
+			if h != host && (err != nil || hostname != host) {
+				return false
+			}
+		}
+		if f.Tag != "" && !hasTag(e.tags, f.Tag) {
+			return false
+		}
+		return true
+	}, nil
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// CacheStatus returns the cached responses matching the filter, for every
+// configured proxy with a cache
+func (p *Proxy) CacheStatus(f CacheFilter) ([]CacheStatus, error) {
+	match, err := f.matcher()
+	if err != nil {
+		return nil, err
+	}
+
+	status := make([]CacheStatus, 0)
+	for _, proxy := range p.config.Proxies {
+		if proxy.cache != nil {
+			status = append(status, proxy.cache.status(proxy.HostPath, match))
+		}
+	}
+
+	return status, nil
+}
+
+// PurgeCache drops the cached responses matching the filter from every
+// configured proxy, returning how many were dropped. An empty filter is
+// refused rather than purging everything.
+func (p *Proxy) PurgeCache(f CacheFilter) (int, error) {
+	if f.empty() {
+		return 0, errEmptyCacheFilter
+	}
+	match, err := f.matcher()
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, proxy := range p.config.Proxies {
+		if proxy.cache != nil {
+			purged += proxy.cache.purge(match)
+		}
+	}
+
+	return purged, nil
+}
+
+func cacheFilter(r *http.Request) CacheFilter {
+	q := r.URL.Query()
+	return CacheFilter{URL: q.Get("url"), Prefix: q.Get("prefix"), Host: q.Get("host"), Tag: q.Get("tag")}
+}
+
+func (p *Proxy) adminHandler() http.Handler {
+	router := NewRouter()
+	router.Get("/metrics", promhttp.Handler())
+	router.Get("/upstreams", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, p.Upstreams())
+	}))
+	router.Get("/cache", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, err := p.CacheStatus(cacheFilter(r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, status)
+	}))
+	router.Delete("/cache", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		purged, err := p.PurgeCache(cacheFilter(r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, map[string]int{"purged": purged})
+	}))
+
+	auth := middleware.NewBasicAuth(os.Getenv(adminUserEnv), os.Getenv(adminPassEnv))
+	return auth.Chain(router)
+}
+
+// adminServer is the server for the admin endpoints, nil when there is no
+// admin listener configured
+func (p *Proxy) adminServer() (*http.Server, error) {
+	a := p.config.Admin
+	if a == nil || a.Addr == "" {
+		return nil, nil
+	}
+	a.normalise()
+	if err := a.validate(); err != nil {
+		return nil, err
+	}
+
+	return &http.Server{Addr: a.Addr, Handler: p.adminHandler()}, nil
+}
+
+func (a *Admin) serve(s *http.Server) error {
+	if a.tls() {
+		return s.ListenAndServeTLS(a.CertFile, a.KeyFile)
+	}
+	return s.ListenAndServe()
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,55 @@
+package liberty
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestAdminServer(t *testing.T) {
+	os.Unsetenv(adminUserEnv)
+	os.Unsetenv(adminPassEnv)
+
+	p := &Proxy{config: &Config{Admin: &Admin{Addr: ":9000"}}}
+	if _, err := p.adminServer(); err == nil {
+		t.Fatalf("admin listener started without its own credentials")
+	}
+
+	os.Setenv(adminUserEnv, "admin")
+	os.Setenv(adminPassEnv, "secret")
+	defer os.Unsetenv(adminUserEnv)
+	defer os.Unsetenv(adminPassEnv)
+
+	s, err := p.adminServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Addr != "127.0.0.1:9000" {
+		t.Errorf("expected the admin listener on the loopback interface, got '%s'", s.Addr)
+	}
+
+	p.config.Admin = &Admin{Addr: ":9000", CertFile: "admin.crt"}
+	if _, err := p.adminServer(); err == nil {
+		t.Errorf("admin listener accepted a certificate without a key")
+	}
+
+	tests := []struct {
+		user, pass string
+		status     int
+	}{
+		{"admin", "secret", http.StatusOK},
+		{"admin", "wrong", http.StatusUnauthorized},
+		{os.Getenv("LIBERTY_USER"), os.Getenv("LIBERTY_PASS"), http.StatusUnauthorized},
+	}
+	h := p.adminHandler()
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/upstreams", nil)
+		r.SetBasicAuth(tt.user, tt.pass)
+		h.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s:%s expected %d, got %d", tt.user, tt.pass, tt.status, w.Code)
+		}
+	}
+}
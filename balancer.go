@@ -0,0 +1,105 @@
+package liberty
+
+import (
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+)
+
+// Load balancing strategies which can be selected with the 'balance' key of a
+// reverse proxy entry in the config.
+const (
+	RoundRobin       = "round_robin"
+	Weighted         = "weighted"
+	LeastOutstanding = "least_outstanding"
+	RandomTwoChoices = "random_two"
+)
+
+// a balancer picks the member of an upstream pool which should receive the
+// next request, it is only ever called with a non empty slice of members and
+// while the pool lock is held.
+type balancer interface {
+	pick(members []*member) *member
+}
+
+func newBalancer(strategy string) (balancer, error) {
+	switch strategy {
+	case RoundRobin, "":
+		return &roundRobin{}, nil
+	case Weighted:
+		return &weighted{}, nil
+	case LeastOutstanding:
+		return &leastOutstanding{}, nil
+	case RandomTwoChoices:
+		return &randomTwo{}, nil
+	}
+
+	return nil, fmt.Errorf("unknown load balancing strategy '%s'", strategy)
+}
+
+// roundRobin hands out each member in turn
+type roundRobin struct {
+	next uint32
+}
+
+func (b *roundRobin) pick(members []*member) *member {
+	n := atomic.AddUint32(&b.next, 1) - 1
+	return members[n%uint32(len(members))]
+}
+
+// weighted is the smooth weighted round robin used by nginx, for weights of
+// 5, 1, 1 the members are picked as a, a, b, a, c, a, a rather than in bursts.
+type weighted struct{}
+
+func (b *weighted) pick(members []*member) *member {
+	var best *member
+	total := 0
+	for _, m := range members {
+		m.current += m.weight
+		total += m.weight
+		if best == nil || m.current > best.current {
+			best = m
+		}
+	}
+	best.current -= total
+
+	return best
+}
+
+// leastOutstanding picks the member with the fewest requests in flight, ties
+// go to the first member found.
+type leastOutstanding struct{}
+
+func (b *leastOutstanding) pick(members []*member) *member {
+	best := members[0]
+	for _, m := range members[1:] {
+		if m.inFlight() < best.inFlight() {
+			best = m
+		}
+	}
+
+	return best
+}
+
+// randomTwo picks two members at random and uses the one with fewer requests
+// in flight, which avoids the herding of a strict least outstanding balancer
+// without needing to look at every member.
+type randomTwo struct{}
+
+func (b *randomTwo) pick(members []*member) *member {
+	if len(members) == 1 {
+		return members[0]
+	}
+
+	i := rand.Intn(len(members))
+	j := rand.Intn(len(members) - 1)
+	if j >= i {
+		j++
+	}
+
+	if members[j].inFlight() < members[i].inFlight() {
+		return members[j]
+	}
+
+	return members[i]
+}
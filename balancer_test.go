@@ -0,0 +1,126 @@
+package liberty
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+)
+
+func testAddrs(n int) []*net.TCPAddr {
+	addrs := make([]*net.TCPAddr, n)
+	for i := range addrs {
+		addrs[i] = &net.TCPAddr{IP: net.IPv4(10, 0, 0, byte(i+1)), Port: 80}
+	}
+	return addrs
+}
+
+func TestRoundRobin(t *testing.T) {
+	p, err := newPool("test", RoundRobin, nil, testAddrs(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 9; i++ {
+		if m := p.next(); m != p.members[i%3] {
+			t.Errorf("pick %d - expected '%s', got '%s'", i, p.members[i%3], m)
+		}
+	}
+}
+
+func TestWeighted(t *testing.T) {
+	weights := map[string]int{"10.0.0.1": 5}
+	p, err := newPool("test", Weighted, weights, testAddrs(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"10.0.0.1", "10.0.0.1", "10.0.0.2", "10.0.0.1", "10.0.0.3", "10.0.0.1", "10.0.0.1"}
+	for i, ip := range expected {
+		if m := p.next(); m.addr.IP.String() != ip {
+			t.Errorf("pick %d - expected '%s', got '%s'", i, ip, m.addr.IP)
+		}
+	}
+}
+
+func TestLeastOutstanding(t *testing.T) {
+	p, err := newPool("test", LeastOutstanding, nil, testAddrs(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.members[0].acquire()
+	p.members[1].acquire()
+
+	if m := p.next(); m != p.members[2] {
+		t.Errorf("expected idle member '%s', got '%s'", p.members[2], m)
+	}
+}
+
+func TestRandomTwoChoices(t *testing.T) {
+	p, err := newPool("test", RandomTwoChoices, nil, testAddrs(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.members[0].acquire()
+
+	// with two members both are always compared, so the idle one must win
+	for i := 0; i < 10; i++ {
+		if m := p.next(); m != p.members[1] {
+			t.Errorf("expected idle member '%s', got '%s'", p.members[1], m)
+		}
+	}
+}
+
+func TestUnknownStrategy(t *testing.T) {
+	if _, err := newPool("test", "fastest", nil, testAddrs(1)); err == nil {
+		t.Error("expected an error for an unknown balancing strategy")
+	}
+}
+
+func TestTransportBalancesPool(t *testing.T) {
+	addrs := make([]*net.TCPAddr, 3)
+	for i := range addrs {
+		v := i
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, v)
+		}))
+		defer server.Close()
+
+		u, _ := url.Parse(server.URL)
+		addrs[i], _ = net.ResolveTCPAddr("tcp", u.Host)
+	}
+
+	remote, _ := url.Parse("http://backend.example.com")
+	rp := httputil.NewSingleHostReverseProxy(remote)
+	tr := testTransport(t, &Transport{}, addrs...)
+	rp.Transport = tr
+	front := httptest.NewServer(rp)
+	defer front.Close()
+
+	seen := map[string]int{}
+	for i := 0; i < 6; i++ {
+		resp, err := http.Get(front.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		seen[string(body)]++
+	}
+
+	for _, v := range []string{"0", "1", "2"} {
+		if seen[v] != 2 {
+			t.Errorf("upstream %s served %d requests, expected 2 - %v", v, seen[v], seen)
+		}
+	}
+
+	for _, m := range tr.pool.members {
+		if m.inFlight() != 0 {
+			t.Errorf("member '%s' has %d requests outstanding after responses closed", m, m.inFlight())
+		}
+	}
+}
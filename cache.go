@@ -0,0 +1,886 @@
+package liberty
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// X-Cache values
+const (
+	cacheHit   = "HIT"
+	cacheMiss  = "MISS"
+	cacheStale = "STALE"
+)
+
+// Cache configures an in memory cache of the responses of an upstream. It is
+// a shared cache following the Cache-Control, Expires and Age headers of the
+// responses, so only responses which say they may be cached are kept. Entries
+// are evicted least recently used first to keep the cache within MaxBytes, and
+// a response bigger than MaxEntryBytes isn't kept at all. A stale entry with an
+// ETag or Last-Modified header is revalidated with the upstream rather than
+// fetched again.
+//
+// Stale responses may be served while they are refreshed in the background, or
+// when the upstream fails or its circuit is open, for as long as the response
+// allows with the stale-while-revalidate and stale-if-error directives. Where a
+// response doesn't say, StaleWhileRevalidate and StaleIfError are used instead.
+// Nothing is served more than MaxStale past its freshness, if it is set.
+//
+// Concurrent GETs for a response which isn't cached wait for the first of them
+// to fetch it, rather than all going to the upstream. A request waiting longer
+// than CoalesceTimeout is sent on by itself.
+//
+// Responses can be tagged by the upstream with surrogate keys in TagHeader,
+// Surrogate-Key by default, separated by spaces, so that they can be purged
+// together.
+type Cache struct {
+	MaxBytes      int64 `yaml:"maxBytes"`
+	MaxEntryBytes int64 `yaml:"maxEntryBytes"`
+
+	StaleWhileRevalidate time.Duration `yaml:"staleWhileRevalidate"`
+	StaleIfError         time.Duration `yaml:"staleIfError"`
+	MaxStale             time.Duration `yaml:"maxStale"`
+
+	CoalesceTimeout time.Duration `yaml:"coalesceTimeout"`
+
+	TagHeader string `yaml:"tagHeader"`
+}
+
+func (c *Cache) normalise() {
+	if c.MaxBytes <= 0 {
+		c.MaxBytes = 64 << 20
+	}
+	if c.MaxEntryBytes <= 0 {
+		c.MaxEntryBytes = 1 << 20
+	}
+	if c.MaxEntryBytes > c.MaxBytes {
+		c.MaxEntryBytes = c.MaxBytes
+	}
+	if c.CoalesceTimeout <= 0 {
+		c.CoalesceTimeout = 5 * time.Second
+	}
+	if c.TagHeader == "" {
+		c.TagHeader = "Surrogate-Key"
+	}
+}
+
+// statuses which may be cached, as listed in RFC 7231
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// cacheControl holds the directives of Cache-Control headers
+type cacheControl map[string]string
+
+func parseCacheControl(values []string) cacheControl {
+	cc := cacheControl{}
+	for _, directive := range splitDirectives(values) {
+		kv := strings.SplitN(directive, "=", 2)
+		name := strings.ToLower(strings.TrimSpace(kv[0]))
+		if len(kv) == 2 {
+			cc[name] = strings.Trim(strings.TrimSpace(kv[1]), `"`)
+		} else {
+			cc[name] = ""
+		}
+	}
+	return cc
+}
+
+func splitDirectives(values []string) []string {
+	directives := make([]string, 0)
+	for _, v := range values {
+		for _, d := range strings.Split(v, ",") {
+			if d = strings.TrimSpace(d); d != "" {
+				directives = append(directives, d)
+			}
+		}
+	}
+	return directives
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
+
+// seconds returns the delta-seconds value of a directive
+func (cc cacheControl) seconds(directive string) (time.Duration, bool) {
+	v, ok := cc[directive]
+	if !ok {
+		return 0, false
+	}
+	secs, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || secs < 0 {
+		return 0, false
+	}
+	return time.Duration(secs) * time.Second, true
+}
+
+// cacheEntry is a stored response, the age follows RFC 7234 section 4.2.3
+type cacheEntry struct {
+	hits int64
+
+	key        string
+	varyNames  []string
+	varyValues []string
+	tags       []string
+
+	status int
+	header http.Header
+	body   []byte
+	size   int64
+
+	responseTime time.Time
+	initialAge   time.Duration
+	lifetime     time.Duration
+	cc           cacheControl
+
+	elem *list.Element
+}
+
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	return e.initialAge + now.Sub(e.responseTime)
+}
+
+func (e *cacheEntry) fresh(now time.Time) bool {
+	return !e.cc.has("no-cache") && e.age(now) < e.lifetime
+}
+
+func (e *cacheEntry) validators() bool {
+	return e.header.Get("Etag") != "" || e.header.Get("Last-Modified") != ""
+}
+
+// matches reports whether the request selects this variant of the response
+func (e *cacheEntry) matches(r *http.Request) bool {
+	for i, name := range e.varyNames {
+		if varyValue(r.Header, name) != e.varyValues[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func varyValue(h http.Header, name string) string {
+	return strings.Join(h[http.CanonicalHeaderKey(name)], ", ")
+}
+
+// update the freshness of the entry from a response, either the one which
+// filled it or a 304 revalidating it
+func (e *cacheEntry) update(header http.Header, requestTime, responseTime time.Time) {
+	e.responseTime = responseTime
+	e.cc = parseCacheControl(header["Cache-Control"])
+
+	date, err := http.ParseTime(header.Get("Date"))
+	if err != nil {
+		date = responseTime
+	}
+
+	var ageValue time.Duration
+	if secs, err := strconv.ParseInt(header.Get("Age"), 10, 64); err == nil && secs > 0 {
+		ageValue = time.Duration(secs) * time.Second
+	}
+	apparentAge := responseTime.Sub(date)
+	if apparentAge < 0 {
+		apparentAge = 0
+	}
+	correctedAge := ageValue + responseTime.Sub(requestTime)
+	e.initialAge = apparentAge
+	if correctedAge > apparentAge {
+		e.initialAge = correctedAge
+	}
+
+	e.lifetime = 0
+	if maxAge, ok := e.cc.seconds("s-maxage"); ok {
+		e.lifetime = maxAge
+	} else if maxAge, ok := e.cc.seconds("max-age"); ok {
+		e.lifetime = maxAge
+	} else if expires := header.Get("Expires"); expires != "" {
+		// an invalid date means already expired
+		if t, err := http.ParseTime(expires); err == nil {
+			e.lifetime = t.Sub(date)
+		}
+	}
+}
+
+// responseCache is the cache of one proxy entry, variants of a response are
+// kept together under its key
+type responseCache struct {
+	conf *Cache
+	now  func() time.Time
+
+	mu         sync.Mutex
+	size       int64
+	lru        *list.List
+	entries    map[string][]*cacheEntry
+	refreshing map[*cacheEntry]bool
+	inflight   map[string]*flight
+}
+
+func newResponseCache(conf *Cache) *responseCache {
+	conf.normalise()
+	return &responseCache{
+		conf:       conf,
+		now:        time.Now,
+		lru:        list.New(),
+		entries:    make(map[string][]*cacheEntry),
+		refreshing: make(map[*cacheEntry]bool),
+		inflight:   make(map[string]*flight),
+	}
+}
+
+type requestURIKey struct{}
+
+// withRequestURI keeps the URI the client asked for, before it is rewritten
+// for the upstream, for the cache key and the response filters
+func withRequestURI(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), requestURIKey{}, r.URL.RequestURI())
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// cacheKey is the key of the GET response for the request, HEAD requests are
+// answered from it too
+func cacheKey(r *http.Request) string {
+	uri, ok := r.Context().Value(requestURIKey{}).(string)
+	if !ok {
+		uri = r.URL.RequestURI()
+	}
+	return "GET " + strings.ToLower(r.Host) + uri
+}
+
+func (c *responseCache) lookup(key string, r *http.Request) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, e := range c.entries[key] {
+		if e.matches(r) {
+			c.lru.MoveToFront(e.elem)
+			return e
+		}
+	}
+	return nil
+}
+
+// store an entry, replacing any variant for the same request headers, and
+// evict the least recently used entries until the cache is back in bounds
+func (c *responseCache) store(e *cacheEntry, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, old := range c.entries[e.key] {
+		if old.matches(r) {
+			c.remove(old)
+			break
+		}
+	}
+
+	e.elem = c.lru.PushFront(e)
+	c.entries[e.key] = append(c.entries[e.key], e)
+	c.size += e.size
+
+	for c.size > c.conf.MaxBytes {
+		c.remove(c.lru.Back().Value.(*cacheEntry))
+	}
+}
+
+// remove must be called with the lock held
+func (c *responseCache) remove(e *cacheEntry) {
+	c.lru.Remove(e.elem)
+	e.elem = nil
+	c.size -= e.size
+
+	variants := c.entries[e.key]
+	for i, v := range variants {
+		if v == e {
+			variants = append(variants[:i], variants[i+1:]...)
+			break
+		}
+	}
+	if len(variants) == 0 {
+		delete(c.entries, e.key)
+	} else {
+		c.entries[e.key] = variants
+	}
+}
+
+// revalidated replaces an entry with a copy updated from the headers of a 304,
+// entries aren't changed once stored as they are read without the lock
+func (c *responseCache) revalidated(e *cacheEntry, header http.Header, requestTime, responseTime time.Time) *cacheEntry {
+	fresh := &cacheEntry{
+		hits:       atomic.LoadInt64(&e.hits),
+		key:        e.key,
+		varyNames:  e.varyNames,
+		varyValues: e.varyValues,
+		status:     e.status,
+		header:     e.header.Clone(),
+		body:       e.body,
+	}
+	for name, values := range header {
+		if name != "Content-Length" {
+			fresh.header[name] = values
+		}
+	}
+	fresh.update(fresh.header, requestTime, responseTime)
+	fresh.tags = c.tags(fresh.header)
+	fresh.size = int64(len(fresh.key) + len(fresh.body) + headerSize(fresh.header))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// the entry may have been evicted while it was revalidated
+	if e.elem == nil {
+		return fresh
+	}
+
+	fresh.elem = e.elem
+	fresh.elem.Value = fresh
+	e.elem = nil
+	c.lru.MoveToFront(fresh.elem)
+	c.size += fresh.size - e.size
+
+	variants := c.entries[e.key]
+	for i, v := range variants {
+		if v == e {
+			variants[i] = fresh
+		}
+	}
+
+	return fresh
+}
+
+// invalidate drops every variant stored under a key
+func (c *responseCache) invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, e := range append([]*cacheEntry(nil), c.entries[key]...) {
+		c.remove(e)
+	}
+}
+
+// tags are the surrogate keys of a response
+func (c *responseCache) tags(header http.Header) []string {
+	var tags []string
+	for _, v := range header[http.CanonicalHeaderKey(c.conf.TagHeader)] {
+		tags = append(tags, strings.Fields(v)...)
+	}
+	return tags
+}
+
+// purge drops the entries matching, returning how many there were
+func (c *responseCache) purge(match func(*cacheEntry) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	purged := 0
+	for elem := c.lru.Front(); elem != nil; {
+		e := elem.Value.(*cacheEntry)
+		elem = elem.Next()
+		if match(e) {
+			c.remove(e)
+			purged++
+		}
+	}
+
+	return purged
+}
+
+// CacheStatus describes the responses cached for a proxy entry
+type CacheStatus struct {
+	Name     string             `json:"name"`
+	Size     int64              `json:"size"`
+	MaxBytes int64              `json:"maxBytes"`
+	Entries  []CacheEntryStatus `json:"entries"`
+}
+
+// CacheEntryStatus describes a cached response, the age and TTL are in
+// seconds and the TTL is negative once the response is stale
+type CacheEntryStatus struct {
+	URL    string            `json:"url"`
+	Vary   map[string]string `json:"vary,omitempty"`
+	Tags   []string          `json:"tags,omitempty"`
+	Status int               `json:"status"`
+	Size   int64             `json:"size"`
+	Age    int64             `json:"age"`
+	TTL    int64             `json:"ttl"`
+	Hits   int64             `json:"hits"`
+}
+
+// status lists the entries matching, most recently used first
+func (c *responseCache) status(name string, match func(*cacheEntry) bool) CacheStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cs := CacheStatus{
+		Name:     name,
+		Size:     c.size,
+		MaxBytes: c.conf.MaxBytes,
+		Entries:  make([]CacheEntryStatus, 0),
+	}
+
+	now := c.now()
+	for elem := c.lru.Front(); elem != nil; elem = elem.Next() {
+		e := elem.Value.(*cacheEntry)
+		if !match(e) {
+			continue
+		}
+
+		age := int64(e.age(now) / time.Second)
+		es := CacheEntryStatus{
+			URL:    strings.TrimPrefix(e.key, "GET "),
+			Tags:   e.tags,
+			Status: e.status,
+			Size:   e.size,
+			Age:    age,
+			TTL:    int64(e.lifetime/time.Second) - age,
+			Hits:   atomic.LoadInt64(&e.hits),
+		}
+		if len(e.varyNames) > 0 {
+			es.Vary = make(map[string]string)
+			for i, name := range e.varyNames {
+				es.Vary[name] = e.varyValues[i]
+			}
+		}
+		cs.Entries = append(cs.Entries, es)
+	}
+
+	return cs
+}
+
+// roundTrip answers the request from the cache where it can, otherwise the
+// request is sent on with next and the response kept if it may be cached
+func (c *responseCache) roundTrip(r *http.Request, next func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		resp, err := next(r)
+		// a successful unsafe request invalidates what is stored for the URL
+		if err == nil && resp.StatusCode < 400 && r.Method != "OPTIONS" && r.Method != "TRACE" {
+			c.invalidate(cacheKey(r))
+		}
+		return markCache(resp, err, cacheMiss)
+	}
+
+	reqCC := parseCacheControl(r.Header["Cache-Control"])
+	if reqCC.has("no-store") {
+		resp, err := next(r)
+		return markCache(resp, err, cacheMiss)
+	}
+
+	key := cacheKey(r)
+	e := c.lookup(key, r)
+	if e != nil && !reqCC.has("no-cache") {
+		now := c.now()
+		if e.fresh(now) {
+			if maxAge, ok := reqCC.seconds("max-age"); !ok || e.age(now) <= maxAge {
+				return c.serve(e, r, cacheHit), nil
+			}
+		} else if c.stale(e, "stale-while-revalidate", c.conf.StaleWhileRevalidate, now) {
+			c.refresh(key, r, e, next)
+			return c.serve(e, r, cacheStale), nil
+		}
+	}
+
+	// the first request for a response fetches it for any others arriving
+	// while it does
+	if r.Method == "GET" && !reqCC.has("no-cache") {
+		f, leader := c.join(key)
+		if leader {
+			resp, err := c.fetch(key, r, e, next)
+			if fill, ok := bodyFill(resp, err); ok {
+				fill.finish = func() { c.land(key, f) }
+			} else {
+				c.land(key, f)
+			}
+			return c.fallback(r, reqCC, e, resp, err)
+		}
+
+		if c.wait(r, f) {
+			if e := c.lookup(key, r); e != nil && e.fresh(c.now()) {
+				return c.serve(e, r, cacheHit), nil
+			}
+		}
+	}
+
+	resp, err := c.fetch(key, r, e, next)
+	return c.fallback(r, reqCC, e, resp, err)
+}
+
+// fallback serves a stale entry in place of an upstream failure, if it may be
+func (c *responseCache) fallback(r *http.Request, reqCC cacheControl, e *cacheEntry, resp *http.Response, err error) (*http.Response, error) {
+	if e != nil && !reqCC.has("no-cache") && failed(resp, err) &&
+		c.stale(e, "stale-if-error", c.conf.StaleIfError, c.now()) {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		return c.serve(e, r, cacheStale), nil
+	}
+
+	return resp, err
+}
+
+// flight is a fetch which other requests for the same key are waiting on
+type flight struct {
+	done chan struct{}
+	once sync.Once
+}
+
+// join the flight for a key, starting one if there isn't one
+func (c *responseCache) join(key string) (*flight, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if f, ok := c.inflight[key]; ok {
+		return f, false
+	}
+	f := &flight{done: make(chan struct{})}
+	c.inflight[key] = f
+	return f, true
+}
+
+// land ends a flight once its response is in the cache, or won't be
+func (c *responseCache) land(key string, f *flight) {
+	c.mu.Lock()
+	if c.inflight[key] == f {
+		delete(c.inflight, key)
+	}
+	c.mu.Unlock()
+
+	f.once.Do(func() { close(f.done) })
+}
+
+// wait for a flight to land, reporting false if it took too long
+func (c *responseCache) wait(r *http.Request, f *flight) bool {
+	timer := time.NewTimer(c.conf.CoalesceTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-f.done:
+		return true
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+	return false
+}
+
+// bodyFill returns the fill of a response being stored in the cache
+func bodyFill(resp *http.Response, err error) (*cacheFill, bool) {
+	if err != nil || resp == nil {
+		return nil, false
+	}
+	fill, ok := resp.Body.(*cacheFill)
+	return fill, ok
+}
+
+// fetch sends the request upstream, revalidating the stored entry if there is
+// one, and fills the cache from the response
+func (c *responseCache) fetch(key string, r *http.Request, e *cacheEntry, next func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	// revalidate the stored response in place of any conditions from the
+	// client, which are then checked against it
+	revalidate := e != nil && e.validators()
+	inm, ims := r.Header["If-None-Match"], r.Header["If-Modified-Since"]
+	if revalidate {
+		defer setConditions(r.Header, inm, ims)
+		setConditions(r.Header, e.header["Etag"], e.header["Last-Modified"])
+	}
+
+	requestTime := c.now()
+	resp, err := next(r)
+	if err != nil {
+		return resp, err
+	}
+	responseTime := c.now()
+
+	if revalidate && resp.StatusCode == http.StatusNotModified {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+
+		// the client's conditions are put back before they are checked
+		setConditions(r.Header, inm, ims)
+
+		return c.serve(c.revalidated(e, resp.Header, requestTime, responseTime), r, cacheHit), nil
+	}
+
+	if r.Method == "GET" && c.storable(r, resp) {
+		c.fill(key, r, resp, requestTime, responseTime)
+	}
+
+	return markCache(resp, nil, cacheMiss)
+}
+
+func setConditions(h http.Header, inm, ims []string) {
+	h.Del("If-None-Match")
+	h.Del("If-Modified-Since")
+	if len(inm) > 0 {
+		h["If-None-Match"] = inm
+	}
+	if len(ims) > 0 {
+		h["If-Modified-Since"] = ims
+	}
+}
+
+// stale reports whether a stale entry may still be served, within the window
+// given by the response directive or else the config, and never more than
+// MaxStale past its freshness. A response which must be revalidated is never
+// served stale.
+func (c *responseCache) stale(e *cacheEntry, directive string, window time.Duration, now time.Time) bool {
+	if e.cc.has("no-cache") || e.cc.has("must-revalidate") || e.cc.has("proxy-revalidate") {
+		return false
+	}
+	if secs, ok := e.cc.seconds(directive); ok {
+		window = secs
+	}
+	if c.conf.MaxStale > 0 && window > c.conf.MaxStale {
+		window = c.conf.MaxStale
+	}
+
+	return window > 0 && e.age(now)-e.lifetime <= window
+}
+
+// failed reports whether the upstream couldn't give a response, including the
+// 503 from an open circuit
+func failed(resp *http.Response, err error) bool {
+	if err != nil || resp == nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// refresh revalidates a stale entry in the background while it is being
+// served, at most once at a time for each entry
+func (c *responseCache) refresh(key string, r *http.Request, e *cacheEntry, next func(*http.Request) (*http.Response, error)) {
+	c.mu.Lock()
+	if c.refreshing[e] {
+		c.mu.Unlock()
+		return
+	}
+	c.refreshing[e] = true
+	c.mu.Unlock()
+
+	// the refresh outlives the client's request, so it gets its own URL and
+	// headers for the transport to set the member's address on
+	req := r.Clone(detachedContext{r.Context()})
+	req.Header.Del("Cache-Control")
+	req.Method = "GET"
+	req.Body = http.NoBody
+	req.ContentLength = 0
+
+	go func() {
+		defer func() {
+			c.mu.Lock()
+			delete(c.refreshing, e)
+			c.mu.Unlock()
+		}()
+
+		resp, err := c.fetch(key, req, e, next)
+		if err != nil {
+			return
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+}
+
+// detachedContext keeps the values of a context without its cancellation
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// storable reports whether a shared cache may keep the response
+func (c *responseCache) storable(r *http.Request, resp *http.Response) bool {
+	if !cacheableStatus[resp.StatusCode] {
+		return false
+	}
+	if resp.ContentLength > c.conf.MaxEntryBytes {
+		return false
+	}
+	if resp.Header.Get("Set-Cookie") != "" || strings.TrimSpace(resp.Header.Get("Vary")) == "*" {
+		return false
+	}
+
+	cc := parseCacheControl(resp.Header["Cache-Control"])
+	if cc.has("no-store") || cc.has("private") {
+		return false
+	}
+	if r.Header.Get("Authorization") != "" && !cc.has("public") && !cc.has("s-maxage") && !cc.has("must-revalidate") {
+		return false
+	}
+
+	// either the response says how long it is fresh for, or it can be
+	// revalidated
+	return cc.has("s-maxage") || cc.has("max-age") || resp.Header.Get("Expires") != "" ||
+		resp.Header.Get("Etag") != "" || resp.Header.Get("Last-Modified") != ""
+}
+
+// fill the cache with the response as its body is read by the client
+func (c *responseCache) fill(key string, r *http.Request, resp *http.Response, requestTime, responseTime time.Time) {
+	e := &cacheEntry{
+		key:    key,
+		status: resp.StatusCode,
+		header: resp.Header.Clone(),
+	}
+	for _, name := range splitDirectives(resp.Header["Vary"]) {
+		e.varyNames = append(e.varyNames, name)
+		e.varyValues = append(e.varyValues, varyValue(r.Header, name))
+	}
+	e.update(e.header, requestTime, responseTime)
+	e.tags = c.tags(e.header)
+
+	resp.Body = &cacheFill{
+		ReadCloser: resp.Body,
+		limit:      c.conf.MaxEntryBytes,
+		length:     resp.ContentLength,
+		done: func(body []byte) {
+			e.body = body
+			e.size = int64(len(key) + len(body) + headerSize(e.header))
+			c.store(e, r)
+		},
+	}
+}
+
+// serve a stored response, or a 304 if it meets the client's conditions
+func (c *responseCache) serve(e *cacheEntry, r *http.Request, status string) *http.Response {
+	atomic.AddInt64(&e.hits, 1)
+
+	header := e.header.Clone()
+	age := e.age(c.now())
+	header.Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+	header.Set("X-Cache", status)
+
+	resp := &http.Response{
+		Status:        strconv.Itoa(e.status) + " " + http.StatusText(e.status),
+		StatusCode:    e.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(e.body)),
+		ContentLength: int64(len(e.body)),
+		Request:       r,
+	}
+
+	if e.status == http.StatusOK && notModified(r, header) {
+		resp.Status = "304 " + http.StatusText(http.StatusNotModified)
+		resp.StatusCode = http.StatusNotModified
+		resp.Body = http.NoBody
+		resp.ContentLength = 0
+		header.Del("Content-Length")
+	} else if r.Method == "HEAD" {
+		resp.Body = http.NoBody
+	}
+
+	return resp
+}
+
+// notModified evaluates the client's conditional headers against a response,
+// If-None-Match takes precedence over If-Modified-Since
+func notModified(r *http.Request, header http.Header) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(header.Get("Etag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+	return err == nil && !lastModified.After(ims)
+}
+
+// markCache sets X-Cache on a response which came through the cache
+func markCache(resp *http.Response, err error, status string) (*http.Response, error) {
+	if err == nil && resp != nil {
+		resp.Header.Set("X-Cache", status)
+	}
+	return resp, err
+}
+
+func headerSize(h http.Header) int {
+	size := 0
+	for name, values := range h {
+		for _, v := range values {
+			size += len(name) + len(v)
+		}
+	}
+	return size
+}
+
+// cacheFill passes a response body through to the client, keeping a copy to
+// store once it has been read in full. A body which is cut short or grows too
+// large isn't stored. Finish is called once the body is stored or closed.
+type cacheFill struct {
+	io.ReadCloser
+	limit  int64
+	length int64
+	buf    bytes.Buffer
+	skip   bool
+	done   func(body []byte)
+	finish func()
+}
+
+func (f *cacheFill) Read(p []byte) (int, error) {
+	n, err := f.ReadCloser.Read(p)
+	if !f.skip && n > 0 {
+		if int64(f.buf.Len()+n) > f.limit {
+			f.skip = true
+			f.buf = bytes.Buffer{}
+		} else {
+			f.buf.Write(p[:n])
+		}
+	}
+
+	if err == io.EOF && !f.skip {
+		f.skip = true
+		if f.length < 0 || int64(f.buf.Len()) == f.length {
+			f.done(f.buf.Bytes())
+		}
+		if f.finish != nil {
+			f.finish()
+		}
+	}
+
+	return n, err
+}
+
+func (f *cacheFill) Close() error {
+	err := f.ReadCloser.Close()
+	if f.finish != nil {
+		f.finish()
+	}
+	return err
+}
@@ -0,0 +1,554 @@
+package liberty
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testClock is moved on by hand to age cached responses
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+// cacheTransport is a transport caching the responses of the handler, whose
+// clock is in step with the cache
+func cacheTransport(t *testing.T, conf *Cache, h http.HandlerFunc) (*Transport, *testClock, func()) {
+	clock := &testClock{now: time.Now()}
+	addr, stop := serverAddr(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", clock.Now().UTC().Format(http.TimeFormat))
+		h(w, r)
+	})
+	cache := newResponseCache(conf)
+	cache.now = clock.Now
+
+	return testTransport(t, &Transport{cache: cache}, addr), clock, stop
+}
+
+// cachedGet makes a request through the transport, returning the response
+// with its body read
+func cachedGet(t *testing.T, tr *Transport, method, url string, header ...string) (*http.Response, string) {
+	req := httptest.NewRequest(method, url, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	return resp, string(body)
+}
+
+func TestCacheHit(t *testing.T) {
+	calls := 0
+	tr, clock, stop := cacheTransport(t, &Cache{}, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprintf(w, "response %d", calls)
+	})
+	defer stop()
+
+	resp, body := cachedGet(t, tr, "GET", "http://example.com/page?a=1")
+	if resp.Header.Get("X-Cache") != cacheMiss || body != "response 1" {
+		t.Fatalf("first request got %s '%s', expected a miss", resp.Header.Get("X-Cache"), body)
+	}
+
+	clock.advance(10 * time.Second)
+	resp, body = cachedGet(t, tr, "GET", "http://example.com/page?a=1")
+	if resp.Header.Get("X-Cache") != cacheHit || body != "response 1" {
+		t.Fatalf("second request got %s '%s', expected a hit", resp.Header.Get("X-Cache"), body)
+	}
+	if resp.Header.Get("Age") != "10" {
+		t.Errorf("expected an age of 10, got '%s'", resp.Header.Get("Age"))
+	}
+	if resp.Header.Get("Server") != "Liberty" {
+		t.Errorf("cached response was not given the proxy headers")
+	}
+
+	resp, body = cachedGet(t, tr, "HEAD", "http://example.com/page?a=1")
+	if resp.Header.Get("X-Cache") != cacheHit || body != "" {
+		t.Errorf("HEAD request was not answered from the cache")
+	}
+
+	// the query is part of the key
+	if _, body = cachedGet(t, tr, "GET", "http://example.com/page?a=2"); body != "response 2" {
+		t.Errorf("a different query was answered from the cache")
+	}
+
+	clock.advance(60 * time.Second)
+	resp, body = cachedGet(t, tr, "GET", "http://example.com/page?a=1")
+	if resp.Header.Get("X-Cache") != cacheMiss || body != "response 3" {
+		t.Errorf("expired response was served, got %s '%s'", resp.Header.Get("X-Cache"), body)
+	}
+}
+
+func TestCacheRevalidate(t *testing.T) {
+	var full, revalidated int
+	tr, _, stop := cacheTransport(t, &Cache{}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Etag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			revalidated++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		full++
+		fmt.Fprint(w, "body")
+	})
+	defer stop()
+
+	cachedGet(t, tr, "GET", "http://example.com/")
+	resp, body := cachedGet(t, tr, "GET", "http://example.com/")
+	if resp.StatusCode != http.StatusOK || body != "body" || resp.Header.Get("X-Cache") != cacheHit {
+		t.Fatalf("revalidated response not served from the cache, got %d '%s'", resp.StatusCode, body)
+	}
+	if full != 1 || revalidated != 1 {
+		t.Errorf("expected 1 full response and 1 revalidation, got %d and %d", full, revalidated)
+	}
+
+	// the client's own conditions are checked against the cache
+	resp, _ = cachedGet(t, tr, "GET", "http://example.com/", "If-None-Match", `"v1"`)
+	if resp.StatusCode != http.StatusNotModified {
+		t.Errorf("expected 304 for a matching ETag, got %d", resp.StatusCode)
+	}
+	resp, body = cachedGet(t, tr, "GET", "http://example.com/", "If-None-Match", `"v0"`)
+	if resp.StatusCode != http.StatusOK || body != "body" {
+		t.Errorf("expected the full response for a stale ETag, got %d", resp.StatusCode)
+	}
+}
+
+func TestCacheVary(t *testing.T) {
+	calls := 0
+	tr, _, stop := cacheTransport(t, &Cache{}, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		fmt.Fprint(w, r.Header.Get("Accept-Language"))
+	})
+	defer stop()
+
+	for i := 0; i < 2; i++ {
+		for _, lang := range []string{"en", "fr"} {
+			if _, body := cachedGet(t, tr, "GET", "http://example.com/", "Accept-Language", lang); body != lang {
+				t.Errorf("expected the '%s' variant, got '%s'", lang, body)
+			}
+		}
+	}
+	if calls != 2 {
+		t.Errorf("expected one upstream request per variant, got %d", calls)
+	}
+}
+
+func TestCacheNotStored(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []string
+		req    []string
+	}{
+		{"no-store", []string{"Cache-Control", "no-store, max-age=60"}, nil},
+		{"private", []string{"Cache-Control", "private, max-age=60"}, nil},
+		{"cookie", []string{"Cache-Control", "max-age=60", "Set-Cookie", "a=b"}, nil},
+		{"vary all", []string{"Cache-Control", "max-age=60", "Vary", "*"}, nil},
+		{"no freshness", nil, nil},
+		{"authorization", []string{"Cache-Control", "max-age=60"}, []string{"Authorization", "Basic eDp5"}},
+		{"client no-store", []string{"Cache-Control", "max-age=60"}, []string{"Cache-Control", "no-store"}},
+	}
+
+	for _, tt := range tests {
+		calls := 0
+		tr, _, stop := cacheTransport(t, &Cache{}, func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			for i := 0; i+1 < len(tt.header); i += 2 {
+				w.Header().Set(tt.header[i], tt.header[i+1])
+			}
+		})
+
+		cachedGet(t, tr, "GET", "http://example.com/", tt.req...)
+		cachedGet(t, tr, "GET", "http://example.com/", tt.req...)
+		if calls != 2 {
+			t.Errorf("%s: response was cached", tt.name)
+		}
+		stop()
+	}
+}
+
+func TestCacheInvalidatedByUnsafeMethod(t *testing.T) {
+	calls := 0
+	tr, _, stop := cacheTransport(t, &Cache{}, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Cache-Control", "max-age=60")
+	})
+	defer stop()
+
+	cachedGet(t, tr, "GET", "http://example.com/item")
+	cachedGet(t, tr, "POST", "http://example.com/item")
+	if resp, _ := cachedGet(t, tr, "GET", "http://example.com/item"); resp.Header.Get("X-Cache") != cacheMiss {
+		t.Errorf("POST did not invalidate the cached response")
+	}
+	if calls != 3 {
+		t.Errorf("expected 3 upstream requests, got %d", calls)
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	tr, _, stop := cacheTransport(t, &Cache{MaxBytes: 2500, MaxEntryBytes: 1500}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		size := 1000
+		if r.URL.Path == "/big" {
+			size = 2000
+		}
+		w.Write(make([]byte, size))
+	})
+	defer stop()
+
+	hit := func(path string) bool {
+		resp, _ := cachedGet(t, tr, "GET", "http://example.com"+path)
+		return resp.Header.Get("X-Cache") == cacheHit
+	}
+
+	hit("/big")
+	if hit("/big") {
+		t.Errorf("response bigger than MaxEntryBytes was cached")
+	}
+
+	hit("/a")
+	hit("/b")
+	// touch a so that b is the least recently used
+	if !hit("/a") {
+		t.Fatalf("/a was not cached")
+	}
+	hit("/c")
+
+	if !hit("/a") || !hit("/c") {
+		t.Errorf("recently used responses were evicted")
+	}
+	if hit("/b") {
+		t.Errorf("least recently used response was not evicted")
+	}
+	if tr.cache.size > tr.cache.conf.MaxBytes {
+		t.Errorf("cache holds %d bytes, more than %d", tr.cache.size, tr.cache.conf.MaxBytes)
+	}
+}
+
+func TestCacheStaleWhileRevalidate(t *testing.T) {
+	var mu sync.Mutex
+	version := 1
+	tr, clock, stop := cacheTransport(t, &Cache{}, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("Cache-Control", "max-age=10, stale-while-revalidate=30")
+		fmt.Fprintf(w, "v%d", version)
+		version++
+	})
+	defer stop()
+
+	cachedGet(t, tr, "GET", "http://example.com/")
+	clock.advance(15 * time.Second)
+
+	stale := httptest.NewRequest("GET", "http://example.com/", nil)
+	resp, err := tr.RoundTrip(stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if body := string(b); resp.Header.Get("X-Cache") != cacheStale || body != "v1" {
+		t.Fatalf("expected the stale response, got %s '%s'", resp.Header.Get("X-Cache"), body)
+	}
+
+	// the refresh happens in the background, on a request of its own as the
+	// client's is still in use
+	var body string
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if stale.URL.Host != "example.com" {
+			t.Fatalf("refresh changed the client's request to '%s'", stale.URL.Host)
+		}
+		resp, body = cachedGet(t, tr, "GET", "http://example.com/")
+		if body == "v2" && resp.Header.Get("X-Cache") == cacheHit {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("stale response was not refreshed, got %s '%s'", resp.Header.Get("X-Cache"), body)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// past the window the client waits for a fresh response
+	clock.advance(time.Minute)
+	if resp, body = cachedGet(t, tr, "GET", "http://example.com/"); body != "v3" || resp.Header.Get("X-Cache") != cacheMiss {
+		t.Errorf("response too stale to serve was used, got %s '%s'", resp.Header.Get("X-Cache"), body)
+	}
+}
+
+func TestCacheStaleIfError(t *testing.T) {
+	tests := []struct {
+		name  string
+		conf  *Cache
+		cc    string
+		after time.Duration
+		stale bool
+	}{
+		{"directive", &Cache{}, "max-age=10, stale-if-error=60", 30 * time.Second, true},
+		{"past directive", &Cache{}, "max-age=10, stale-if-error=60", 80 * time.Second, false},
+		{"config", &Cache{StaleIfError: time.Minute}, "max-age=10", 30 * time.Second, true},
+		{"max stale", &Cache{MaxStale: 20 * time.Second}, "max-age=10, stale-if-error=3600", time.Minute, false},
+		{"must revalidate", &Cache{StaleIfError: time.Minute}, "max-age=10, must-revalidate", 30 * time.Second, false},
+		{"none", &Cache{}, "max-age=10", 30 * time.Second, false},
+	}
+
+	for _, tt := range tests {
+		var mu sync.Mutex
+		down := false
+		tr, clock, stop := cacheTransport(t, tt.conf, func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			if down {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Header().Set("Cache-Control", tt.cc)
+			fmt.Fprint(w, "cached")
+		})
+
+		cachedGet(t, tr, "GET", "http://example.com/")
+		mu.Lock()
+		down = true
+		mu.Unlock()
+		clock.advance(tt.after)
+
+		resp, body := cachedGet(t, tr, "GET", "http://example.com/")
+		served := resp.StatusCode == http.StatusOK && body == "cached" && resp.Header.Get("X-Cache") == cacheStale
+		if served != tt.stale {
+			t.Errorf("%s: expected stale response %v, got %d %s '%s'", tt.name, tt.stale, resp.StatusCode, resp.Header.Get("X-Cache"), body)
+		}
+		stop()
+	}
+}
+
+func TestCacheStaleIfUpstreamDown(t *testing.T) {
+	tr, clock, stop := cacheTransport(t, &Cache{StaleIfError: time.Minute}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=10")
+		w.Header().Set("Etag", `"v1"`)
+		fmt.Fprint(w, "cached")
+	})
+
+	cachedGet(t, tr, "GET", "http://example.com/")
+	stop()
+	clock.advance(30 * time.Second)
+
+	// the client's conditions are still checked against the stale response
+	resp, _ := cachedGet(t, tr, "GET", "http://example.com/", "If-None-Match", `"v0"`)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Cache") != cacheStale {
+		t.Errorf("expected the stale response with the upstream down, got %d %s", resp.StatusCode, resp.Header.Get("X-Cache"))
+	}
+}
+
+func TestCacheCoalesce(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+	tr, _, stop := cacheTransport(t, &Cache{}, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		started <- struct{}{}
+		<-release
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprint(w, "shared")
+	})
+	defer stop()
+
+	var wg sync.WaitGroup
+	bodies := make([]string, 5)
+	for i := range bodies {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, bodies[i] = cachedGet(t, tr, "GET", "http://example.com/hot")
+		}(i)
+	}
+
+	<-started
+	// give the other requests time to join the fetch
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("expected one upstream request, got %d", calls)
+	}
+	for i, body := range bodies {
+		if body != "shared" {
+			t.Errorf("request %d got '%s'", i, body)
+		}
+	}
+}
+
+func TestCacheCoalesceTimeout(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	tr, _, stop := cacheTransport(t, &Cache{CoalesceTimeout: 20 * time.Millisecond}, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls++
+		first := calls == 1
+		mu.Unlock()
+		if first {
+			time.Sleep(300 * time.Millisecond)
+		}
+		fmt.Fprint(w, "slow")
+	})
+	defer stop()
+
+	done := make(chan struct{})
+	go func() {
+		cachedGet(t, tr, "GET", "http://example.com/slow")
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	if _, body := cachedGet(t, tr, "GET", "http://example.com/slow"); body != "slow" {
+		t.Errorf("waiting request got '%s'", body)
+	}
+	if time.Since(start) > 200*time.Millisecond {
+		t.Errorf("waiting request was not sent on after the coalesce timeout")
+	}
+	<-done
+
+	if calls != 2 {
+		t.Errorf("expected the waiting request to go upstream, got %d requests", calls)
+	}
+}
+
+func TestCacheCoalesceUncacheable(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	release := make(chan struct{})
+	tr, _, stop := cacheTransport(t, &Cache{}, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		<-release
+		w.Header().Set("Cache-Control", "no-store")
+	})
+	defer stop()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cachedGet(t, tr, "GET", "http://example.com/private")
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	// waiters can't share a response which isn't stored, so each is sent on
+	if calls != 3 {
+		t.Errorf("expected every request to reach the upstream, got %d", calls)
+	}
+}
+
+func TestCachePurge(t *testing.T) {
+	tr, clock, stop := cacheTransport(t, &Cache{}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Surrogate-Key", r.URL.Query().Get("tags"))
+		fmt.Fprint(w, r.URL.Path)
+	})
+	defer stop()
+
+	p := &Proxy{config: &Config{Proxies: []*ReverseProxy{{HostPath: "test"}, {HostPath: "cached", cache: tr.cache}}}}
+	urls := []string{
+		"http://example.com/static/a.css?tags=css%20static",
+		"http://example.com/static/b.js?tags=static",
+		"http://example.com/page?tags=page",
+		"http://example.com:8080/page",
+		"http://other.com/static/a.css",
+	}
+	fill := func() {
+		tr.cache.purge(func(*cacheEntry) bool { return true })
+		for _, u := range urls {
+			cachedGet(t, tr, "GET", u)
+		}
+	}
+
+	tests := []struct {
+		filter CacheFilter
+		purged int
+	}{
+		{CacheFilter{URL: "https://example.com/page?tags=page"}, 1},
+		{CacheFilter{URL: "https://example.com/page"}, 0},
+		{CacheFilter{Prefix: "https://example.com/static/"}, 2},
+		{CacheFilter{Host: "example.com"}, 4},
+		{CacheFilter{Host: "example.com:8080"}, 1},
+		{CacheFilter{Tag: "static"}, 2},
+		{CacheFilter{Tag: "css", Host: "other.com"}, 0},
+	}
+	for _, tt := range tests {
+		fill()
+		purged, err := p.PurgeCache(tt.filter)
+		if err != nil {
+			t.Errorf("%+v: %s", tt.filter, err)
+			continue
+		}
+		if purged != tt.purged {
+			t.Errorf("%+v: purged %d entries, expected %d", tt.filter, purged, tt.purged)
+		}
+	}
+
+	if _, err := p.PurgeCache(CacheFilter{}); err != errEmptyCacheFilter {
+		t.Errorf("empty filter was not refused")
+	}
+	if _, err := p.PurgeCache(CacheFilter{URL: "/page"}); err == nil {
+		t.Errorf("URL without a host was accepted")
+	}
+
+	// a purged response is fetched again
+	fill()
+	p.PurgeCache(CacheFilter{Tag: "page"})
+	if resp, _ := cachedGet(t, tr, "GET", urls[2]); resp.Header.Get("X-Cache") != cacheMiss {
+		t.Errorf("purged response was served from the cache")
+	}
+
+	clock.advance(5 * time.Second)
+	cachedGet(t, tr, "GET", urls[0])
+	status, err := p.CacheStatus(CacheFilter{URL: "http://example.com/static/a.css?tags=css%20static"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status) != 1 || status[0].Name != "cached" || len(status[0].Entries) != 1 {
+		t.Fatalf("expected one matching entry for the cached proxy, got %+v", status)
+	}
+	es := status[0].Entries[0]
+	// the Date header is to the second, so the age may be counted from
+	// slightly earlier
+	if es.URL != "example.com/static/a.css?tags=css%20static" || es.Age < 5 || es.Age > 6 || es.TTL != 60-es.Age || es.Hits != 1 ||
+		es.Status != http.StatusOK || es.Size <= 0 || len(es.Tags) != 2 {
+		t.Errorf("unexpected entry status %+v", es)
+	}
+}
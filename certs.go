@@ -0,0 +1,238 @@
+package liberty
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// how often certificate files are checked for changes
+const certReloadInterval = 30 * time.Second
+
+var errNoCertificate = errors.New("no certificate for server name")
+
+// staticCert is a certificate loaded from files named in the config
+type staticCert struct {
+	crt     *Crt
+	cert    *tls.Certificate
+	names   []string
+	modTime time.Time
+}
+
+func loadStaticCert(crt *Crt) (*staticCert, error) {
+	cert, err := tls.LoadX509KeyPair(crt.CertFile, crt.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	modTime, err := crtModTime(crt)
+	if err != nil {
+		return nil, err
+	}
+
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	// the configured domain if there is one, otherwise the names the
+	// certificate was issued for
+	names := cert.Leaf.DNSNames
+	if crt.Domain != "" {
+		names = []string{crt.Domain}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("certificate '%s' has no domain", crt.CertFile)
+	}
+
+	return &staticCert{crt: crt, cert: &cert, names: names, modTime: modTime}, nil
+}
+
+// crtModTime is the latest modification time of the certificate and key files
+func crtModTime(crt *Crt) (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{crt.CertFile, crt.KeyFile} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return latest, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// certStore holds the statically configured certificates by server name,
+// names may be wildcards such as "*.example.com".
+type certStore struct {
+	mu     sync.RWMutex
+	certs  []*staticCert
+	byName map[string]*staticCert
+	done   chan struct{}
+}
+
+func newCertStore(crts []*Crt) *certStore {
+	cs := &certStore{
+		byName: make(map[string]*staticCert),
+		done:   make(chan struct{}),
+	}
+
+	for _, crt := range crts {
+		sc, err := loadStaticCert(crt)
+		if err != nil {
+			log.Printf("the certificate for '%s' was not loaded - %s", crt.Domain, err)
+			continue
+		}
+		cs.certs = append(cs.certs, sc)
+	}
+	cs.index()
+
+	return cs
+}
+
+// index must be called with the write lock held, or before the store is shared
+func (cs *certStore) index() {
+	cs.byName = make(map[string]*staticCert)
+	for _, sc := range cs.certs {
+		for _, name := range sc.names {
+			cs.byName[strings.ToLower(name)] = sc
+		}
+	}
+}
+
+// lookup finds the certificate for a server name, an exact match is preferred
+// over a wildcard, which only covers a single label.
+func (cs *certStore) lookup(name string) *tls.Certificate {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if name == "" {
+		return nil
+	}
+
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	if sc, ok := cs.byName[name]; ok {
+		return sc.cert
+	}
+	if i := strings.Index(name, "."); i > 0 {
+		if sc, ok := cs.byName["*"+name[i:]]; ok {
+			return sc.cert
+		}
+	}
+
+	return nil
+}
+
+func (cs *certStore) run() {
+	ticker := time.NewTicker(certReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-cs.done:
+			return
+		case <-ticker.C:
+		}
+
+		cs.reload()
+	}
+}
+
+// reload any certificates whose files have changed, a certificate which fails
+// to load keeps being served until it is fixed.
+func (cs *certStore) reload() {
+	cs.mu.RLock()
+	certs := cs.certs
+	cs.mu.RUnlock()
+
+	reloaded := make([]*staticCert, len(certs))
+	changed := false
+	for i, sc := range certs {
+		reloaded[i] = sc
+
+		modTime, err := crtModTime(sc.crt)
+		if err != nil || !modTime.After(sc.modTime) {
+			continue
+		}
+
+		fresh, err := loadStaticCert(sc.crt)
+		if err != nil {
+			log.Printf("the certificate '%s' was not reloaded - %s", sc.crt.CertFile, err)
+			continue
+		}
+		log.Printf("reloaded certificate '%s'", sc.crt.CertFile)
+		reloaded[i] = fresh
+		changed = true
+	}
+
+	if !changed {
+		return
+	}
+
+	cs.mu.Lock()
+	cs.certs = reloaded
+	cs.index()
+	cs.mu.Unlock()
+}
+
+func (cs *certStore) close() {
+	close(cs.done)
+}
+
+// certSelector serves the static certificates, then falls back to ACME for
+// any other server name. TLS-ALPN-01 challenges always go to ACME, if the
+// challenge is allowed for the server name. Certificates are stapled with
+// OCSP responses unless stapling is disabled. Client certificates are only
+// asked for on the hosts of proxy entries with client auth.
+type certSelector struct {
+	static     *certStore
+	acme       *autocert.Manager
+	challenges *challengePolicy
+	ocsp       *stapler
+	clientAuth map[string]bool
+}
+
+// clientCerts reports whether client certificates are asked for on the host
+func (sel *certSelector) clientCerts(name string) bool {
+	return sel.clientAuth[strings.ToLower(strings.TrimSuffix(name, "."))]
+}
+
+func (sel *certSelector) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if isALPNChallenge(hello) {
+		if sel.acme == nil || !sel.challenges.allows(hello.ServerName, TLSALPN01) {
+			return nil, errChallengeNotAllowed
+		}
+		return sel.acme.GetCertificate(hello)
+	}
+
+	if sel.static != nil {
+		if cert := sel.static.lookup(hello.ServerName); cert != nil {
+			return sel.ocsp.staple(cert), nil
+		}
+	}
+
+	if sel.acme == nil {
+		return nil, errNoCertificate
+	}
+
+	cert, err := sel.acme.GetCertificate(hello)
+	if err != nil {
+		return nil, err
+	}
+
+	return sel.ocsp.staple(cert), nil
+}
+
+// the CA offers only the acme-tls/1 protocol when validating a challenge
+func isALPNChallenge(hello *tls.ClientHelloInfo) bool {
+	return len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto
+}
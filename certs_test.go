@@ -0,0 +1,137 @@
+package liberty
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self signed certificate and key for the names to dir
+func writeTestCert(t *testing.T, dir, prefix string, names ...string) *Crt {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crt := &Crt{
+		CertFile: filepath.Join(dir, prefix+".crt"),
+		KeyFile:  filepath.Join(dir, prefix+".key"),
+	}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := ioutil.WriteFile(crt.CertFile, certPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(crt.KeyFile, keyPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return crt
+}
+
+func TestCertStoreLookup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "liberty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	exact := writeTestCert(t, dir, "exact", "www.example.com")
+	wildcard := writeTestCert(t, dir, "wildcard", "*.example.com")
+	cs := newCertStore([]*Crt{exact, wildcard})
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"www.example.com", "www.example.com"},
+		{"WWW.Example.com.", "www.example.com"},
+		{"api.example.com", "*.example.com"},
+		{"a.b.example.com", ""},
+		{"example.com", ""},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		cert := cs.lookup(test.name)
+		if test.want == "" {
+			if cert != nil {
+				t.Errorf("%s - expected no certificate, got %s", test.name, cert.Leaf.DNSNames)
+			}
+			continue
+		}
+		if cert == nil || cert.Leaf.DNSNames[0] != test.want {
+			t.Errorf("%s - expected the certificate for %s", test.name, test.want)
+		}
+	}
+
+	sel := &certSelector{static: cs}
+	if _, err := sel.GetCertificate(&tls.ClientHelloInfo{ServerName: "www.example.com"}); err != nil {
+		t.Error(err)
+	}
+	if _, err := sel.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.org"}); err != errNoCertificate {
+		t.Errorf("expected errNoCertificate, got %v", err)
+	}
+}
+
+func TestCertStoreReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "liberty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	crt := writeTestCert(t, dir, "site", "www.example.com")
+	cs := newCertStore([]*Crt{crt})
+	before := cs.lookup("www.example.com")
+
+	// a half written certificate keeps the old one in service
+	if err := ioutil.WriteFile(crt.CertFile, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(crt.CertFile, later, later)
+	cs.reload()
+	if cs.lookup("www.example.com") != before {
+		t.Fatal("certificate replaced by a broken file")
+	}
+
+	writeTestCert(t, dir, "site", "www.example.com")
+	later = later.Add(time.Minute)
+	os.Chtimes(crt.CertFile, later, later)
+	os.Chtimes(crt.KeyFile, later, later)
+	cs.reload()
+
+	after := cs.lookup("www.example.com")
+	if after == nil || after == before {
+		t.Fatal("changed certificate was not reloaded")
+	}
+	if after.Leaf.SerialNumber.Cmp(before.Leaf.SerialNumber) == 0 {
+		t.Error("reloaded certificate has the old serial number")
+	}
+}
@@ -0,0 +1,177 @@
+package liberty
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+var (
+	errNoClientCert     = errors.New("no client certificate")
+	errClientNotAllowed = errors.New("client certificate not allowed")
+)
+
+// ClientAuth configures mutual TLS for a proxy entry. Client certificates must
+// be issued by a CA in the CAFile bundle, and are only asked for on the hosts
+// of entries with client auth, so a request reaching one of them over a
+// connection made for another host gets a 421. Without Required a client
+// sending no certificate is let through, but a certificate which fails
+// verification is always refused.
+//
+// Subjects and SANs are regular expressions, a certificate is allowed if its
+// subject or any of its DNS, email, URI or IP SANs match in full. With neither
+// set, any certificate from the CA is allowed. The verified subject is sent to
+// the upstream in Header, if set, and any value sent by the client is removed.
+type ClientAuth struct {
+	CAFile   string   `yaml:"caFile"`
+	Required bool     `yaml:"required"`
+	Subjects []string `yaml:"subjects, flow"`
+	SANs     []string `yaml:"sans, flow"`
+	Header   string   `yaml:"header"`
+}
+
+// ClientIdentity is the verified identity of a client from its certificate
+type ClientIdentity struct {
+	Subject     string
+	SANs        []string
+	Certificate *x509.Certificate
+}
+
+type clientIdentityKey struct{}
+
+// VerifiedClient returns the identity of a client which authenticated with a
+// certificate, or nil
+func VerifiedClient(r *http.Request) *ClientIdentity {
+	id, _ := r.Context().Value(clientIdentityKey{}).(*ClientIdentity)
+	return id
+}
+
+// clientAuth verifies client certificates after the handshake, so that entries
+// for different paths on the same host can trust different CAs
+type clientAuth struct {
+	required bool
+	header   string
+	roots    *x509.CertPool
+	subjects []*regexp.Regexp
+	sans     []*regexp.Regexp
+}
+
+func newClientAuth(conf *ClientAuth) (*clientAuth, error) {
+	pem, err := ioutil.ReadFile(conf.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in '%s'", conf.CAFile)
+	}
+
+	ca := &clientAuth{required: conf.Required, header: conf.Header, roots: roots}
+	if ca.subjects, err = fullMatches(conf.Subjects); err != nil {
+		return nil, err
+	}
+	if ca.sans, err = fullMatches(conf.SANs); err != nil {
+		return nil, err
+	}
+
+	return ca, nil
+}
+
+func fullMatches(patterns []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, len(patterns))
+	for i, p := range patterns {
+		re, err := regexp.Compile("^(?:" + p + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("cannot compile client certificate pattern '%s' - %s", p, err)
+		}
+		res[i] = re
+	}
+	return res, nil
+}
+
+func (ca *clientAuth) Chain(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ca.header != "" {
+			r.Header.Del(ca.header)
+		}
+
+		id, err := ca.verify(r)
+		if err == errNoClientCert && !ca.required {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		if ca.header != "" {
+			r.Header.Set(ca.header, id.Subject)
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIdentityKey{}, id)))
+	})
+}
+
+func (ca *clientAuth) verify(r *http.Request) (*ClientIdentity, error) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil, errNoClientCert
+	}
+
+	leaf := r.TLS.PeerCertificates[0]
+	intermediates := x509.NewCertPool()
+	for _, cert := range r.TLS.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         ca.roots,
+		Intermediates: intermediates,
+		CurrentTime:   time.Now(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	id := &ClientIdentity{Subject: leaf.Subject.String(), Certificate: leaf}
+	id.SANs = append(id.SANs, leaf.DNSNames...)
+	id.SANs = append(id.SANs, leaf.EmailAddresses...)
+	for _, uri := range leaf.URIs {
+		id.SANs = append(id.SANs, uri.String())
+	}
+	for _, ip := range leaf.IPAddresses {
+		id.SANs = append(id.SANs, ip.String())
+	}
+
+	if !ca.allowed(id) {
+		return nil, errClientNotAllowed
+	}
+
+	return id, nil
+}
+
+func (ca *clientAuth) allowed(id *ClientIdentity) bool {
+	if len(ca.subjects) == 0 && len(ca.sans) == 0 {
+		return true
+	}
+
+	for _, re := range ca.subjects {
+		if re.MatchString(id.Subject) {
+			return true
+		}
+	}
+	for _, re := range ca.sans {
+		for _, san := range id.SANs {
+			if re.MatchString(san) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
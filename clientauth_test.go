@@ -0,0 +1,157 @@
+package liberty
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testClientCA creates a CA, writing it to dir, and a client certificate
+// issued by it
+func testClientCA(t *testing.T, dir, name string) (caFile string, client *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name + " CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDer)
+
+	clientTmpl := &x509.Certificate{
+		SerialNumber:   big.NewInt(2),
+		Subject:        pkix.Name{CommonName: "billing", Organization: []string{name}},
+		EmailAddresses: []string{"billing@example.com"},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	clientDer, err := x509.CreateCertificate(rand.Reader, clientTmpl, ca, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, _ = x509.ParseCertificate(clientDer)
+
+	caFile = filepath.Join(dir, name+".pem")
+	if err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return caFile, client
+}
+
+func TestClientAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "liberty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	caFile, client := testClientCA(t, dir, "trusted")
+	_, stranger := testClientCA(t, dir, "other")
+
+	tests := []struct {
+		conf    ClientAuth
+		cert    *x509.Certificate
+		code    int
+		subject string
+	}{
+		{ClientAuth{}, nil, http.StatusOK, ""},
+		{ClientAuth{Required: true}, nil, http.StatusForbidden, ""},
+		{ClientAuth{}, client, http.StatusOK, "CN=billing,O=trusted"},
+		{ClientAuth{}, stranger, http.StatusForbidden, ""},
+		{ClientAuth{Subjects: []string{"CN=billing,.*"}}, client, http.StatusOK, "CN=billing,O=trusted"},
+		{ClientAuth{Subjects: []string{"CN=bill"}}, client, http.StatusForbidden, ""},
+		{ClientAuth{SANs: []string{`.*@example\.com`}}, client, http.StatusOK, "CN=billing,O=trusted"},
+		{ClientAuth{SANs: []string{`.*@example\.org`}}, client, http.StatusForbidden, ""},
+	}
+
+	for i, test := range tests {
+		test.conf.CAFile = caFile
+		test.conf.Header = "X-Client-Subject"
+		ca, err := newClientAuth(&test.conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var subject, header string
+		h := ca.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if id := VerifiedClient(r); id != nil {
+				subject = id.Subject
+			}
+			header = r.Header.Get("X-Client-Subject")
+		}))
+
+		r := httptest.NewRequest("GET", "https://example.com/", nil)
+		r.Header.Set("X-Client-Subject", "CN=admin")
+		if test.cert != nil {
+			r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{test.cert}}
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if w.Code != test.code {
+			t.Errorf("test %d - expected status %d, got %d", i, test.code, w.Code)
+		}
+		if subject != test.subject || header != test.subject {
+			t.Errorf("test %d - expected subject '%s', got '%s' and header '%s'", i, test.subject, subject, header)
+		}
+	}
+}
+
+func TestClientAuthMisdirected(t *testing.T) {
+	reached := false
+	router := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { reached = true })
+	p := &Proxy{
+		secure: map[string]*VHost{
+			"mtls.example.com": {host: "mtls.example.com", handler: router},
+			"www.example.com":  {host: "www.example.com", handler: router},
+		},
+		certs: &certSelector{clientAuth: map[string]bool{"mtls.example.com": true}},
+	}
+
+	tests := []struct {
+		host, serverName string
+		code             int
+	}{
+		{"mtls.example.com", "mtls.example.com", http.StatusOK},
+		{"www.example.com", "mtls.example.com", http.StatusOK},
+		{"www.example.com", "www.example.com", http.StatusOK},
+		// a connection coalesced from another host never asked for a cert
+		{"mtls.example.com", "www.example.com", http.StatusMisdirectedRequest},
+	}
+
+	for _, test := range tests {
+		reached = false
+		r := httptest.NewRequest("GET", "https://"+test.host+"/", nil)
+		r.TLS = &tls.ConnectionState{ServerName: test.serverName}
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+
+		if w.Code != test.code || reached != (test.code == http.StatusOK) {
+			t.Errorf("%s on a connection for %s - expected status %d, got %d", test.host, test.serverName, test.code, w.Code)
+		}
+	}
+}
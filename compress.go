@@ -0,0 +1,328 @@
+package liberty
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// content encodings liberty can compress responses with
+const (
+	Gzip   = "gzip"
+	Brotli = "br"
+	Zstd   = "zstd"
+)
+
+// Compression configures compressing the responses of a proxy entry. The
+// Algorithms are in order of preference, used when a client accepts more than
+// one equally. Responses with a Content-Length smaller than MinSize, or
+// without a content type matching Types, are passed on as they are, as are
+// responses which the upstream has already compressed. With Recompress those
+// are decompressed and compressed again in an encoding the client prefers.
+// Bodies of unknown length and event streams may be streamed, so they are
+// compressed whatever their size and flushed as each chunk arrives.
+//
+// Level is the compression level, from 1 for the fastest up to 9 for gzip and
+// 11 for brotli, zstd levels are mapped to its nearest speed. Left out, each
+// algorithm uses its default.
+type Compression struct {
+	Algorithms []string `yaml:"algorithms, flow"`
+	MinSize    int64    `yaml:"minSize"`
+	Types      []string `yaml:"types, flow"`
+	Level      int      `yaml:"level"`
+	Recompress bool     `yaml:"recompress"`
+}
+
+func (c *Compression) normalise() {
+	if len(c.Algorithms) == 0 {
+		c.Algorithms = []string{Brotli, Zstd, Gzip}
+	}
+	if c.MinSize <= 0 {
+		c.MinSize = 1024
+	}
+	if len(c.Types) == 0 {
+		c.Types = append([]string{"application/json", "image/svg+xml"}, DefaultTypes...)
+	}
+}
+
+// compressor encodes responses in the best encoding the client accepts
+type compressor struct {
+	conf *Compression
+}
+
+func newCompressor(conf *Compression) (*compressor, error) {
+	conf.normalise()
+	for i, alg := range conf.Algorithms {
+		alg = strings.ToLower(alg)
+		if alg != Gzip && alg != Brotli && alg != Zstd {
+			return nil, fmt.Errorf("unknown compression algorithm '%s'", alg)
+		}
+		conf.Algorithms[i] = alg
+	}
+	if conf.Level < 0 {
+		return nil, fmt.Errorf("cannot use compression level %d", conf.Level)
+	}
+
+	return &compressor{conf: conf}, nil
+}
+
+// negotiate picks the encoding the client gives the highest quality, ties go
+// to the first in the configured order. Nothing is picked if the client
+// accepts none of them.
+func (c *compressor) negotiate(acceptEncoding string) string {
+	accepted := make(map[string]float64)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		accepted[name] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, alg := range c.conf.Algorithms {
+		q, ok := accepted[alg]
+		if !ok {
+			q, ok = accepted["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = alg, q
+		}
+	}
+
+	return best
+}
+
+// compressible reports whether the response may be compressed at all, which
+// also decides whether it varies by Accept-Encoding
+func (c *compressor) compressible(r *http.Request, resp *http.Response) bool {
+	if r.Method == "HEAD" || resp.Header.Get("Content-Range") != "" {
+		return false
+	}
+	switch resp.StatusCode {
+	case http.StatusNoContent, http.StatusPartialContent, http.StatusNotModified, http.StatusSwitchingProtocols:
+		return false
+	}
+	if parseCacheControl(resp.Header["Cache-Control"]).has("no-transform") {
+		return false
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	for _, t := range c.conf.Types {
+		if typeMatches(t, contentType) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply compresses the response if the client accepts an encoding and it is
+// big enough to be worth it
+func (c *compressor) apply(r *http.Request, resp *http.Response) {
+	if !c.compressible(r, resp) {
+		return
+	}
+	addVary(resp.Header, "Accept-Encoding")
+
+	current := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if current == "identity" {
+		current = ""
+	}
+	if current != "" && (!c.conf.Recompress || !decodable[current]) {
+		return
+	}
+
+	alg := c.negotiate(r.Header.Get("Accept-Encoding"))
+	if alg == "" || alg == current {
+		return
+	}
+
+	// reading ahead to find the size would hold back a streamed body, so only
+	// a known length is held to the minimum
+	stream := resp.ContentLength < 0 || typeMatches("text/event-stream", resp.Header.Get("Content-Type"))
+	if !stream && resp.ContentLength < c.conf.MinSize {
+		return
+	}
+
+	resp.Body = compressBody(resp.Body, current, alg, c.conf.Level, stream)
+	resp.Header.Set("Content-Encoding", alg)
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+
+	// the encoded body is a different representation
+	if etag := resp.Header.Get("Etag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("Etag", "W/"+etag)
+	}
+}
+
+func addVary(h http.Header, name string) {
+	for _, v := range splitDirectives(h["Vary"]) {
+		if v == "*" || strings.EqualFold(v, name) {
+			return
+		}
+	}
+	h.Add("Vary", name)
+}
+
+// compressedBody is read while the upstream body is encoded in the background,
+// closing it stops the encoding
+type compressedBody struct {
+	*io.PipeReader
+	body io.Closer
+}
+
+func (b compressedBody) Close() error {
+	b.PipeReader.Close()
+	return b.body.Close()
+}
+
+// compressBody encodes the body with the algorithm, decoding it first if it is
+// already encoded. A streamed body is flushed after each read so the client
+// gets it as it comes.
+func compressBody(body io.ReadCloser, current, alg string, level int, stream bool) io.ReadCloser {
+	pr, pw := io.Pipe()
+
+	go func() {
+		defer body.Close()
+
+		var src io.Reader = body
+		if current != "" {
+			dec, err := decoder(current, body)
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			defer dec.Close()
+			src = dec
+		}
+
+		enc, err := encoder(alg, level, pw)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if stream {
+			err = copyFlushed(enc, src)
+		} else {
+			_, err = io.Copy(enc, src)
+		}
+		if err == nil {
+			err = enc.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	return compressedBody{PipeReader: pr, body: body}
+}
+
+// encoders which can write out what they have buffered
+type flusher interface {
+	Flush() error
+}
+
+// copyFlushed copies like io.Copy, flushing the encoder after each read
+func copyFlushed(enc io.Writer, src io.Reader) error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, werr := enc.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			if f, ok := enc.(flusher); ok {
+				if ferr := f.Flush(); ferr != nil {
+					return ferr
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func encoder(alg string, level int, w io.Writer) (io.WriteCloser, error) {
+	switch alg {
+	case Brotli:
+		if level == 0 {
+			level = brotli.DefaultCompression
+		}
+		if level > brotli.BestCompression {
+			level = brotli.BestCompression
+		}
+		return brotli.NewWriterLevel(w, level), nil
+	case Zstd:
+		speed := zstd.SpeedDefault
+		if level > 0 {
+			speed = zstd.EncoderLevelFromZstd(level)
+		}
+		// one response is a single stream, so one goroutine is enough
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(speed), zstd.WithEncoderConcurrency(1))
+	}
+
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	if level > gzip.BestCompression {
+		level = gzip.BestCompression
+	}
+	return gzip.NewWriterLevel(w, level)
+}
+
+type zstdReader struct {
+	*zstd.Decoder
+}
+
+func (r zstdReader) Close() error {
+	r.Decoder.Close()
+	return nil
+}
+
+// encodings which can be decoded to compress again
+var decodable = map[string]bool{
+	Gzip:      true,
+	"x-gzip":  true,
+	"deflate": true,
+	Brotli:    true,
+	Zstd:      true,
+}
+
+func decoder(encoding string, r io.Reader) (io.ReadCloser, error) {
+	switch encoding {
+	case Gzip, "x-gzip":
+		return gzip.NewReader(r)
+	case "deflate":
+		return zlib.NewReader(r)
+	case Brotli:
+		return ioutil.NopCloser(brotli.NewReader(r)), nil
+	case Zstd:
+		dec, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return zstdReader{dec}, nil
+	}
+
+	return nil, fmt.Errorf("cannot decode content encoding '%s'", encoding)
+}
@@ -0,0 +1,202 @@
+package liberty
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+func testCompressor(t *testing.T, conf *Compression) *compressor {
+	c, err := newCompressor(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func decode(t *testing.T, encoding string, body string) string {
+	var r io.Reader = strings.NewReader(body)
+	switch encoding {
+	case Gzip:
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = gz
+	case Brotli:
+		r = brotli.NewReader(r)
+	case Zstd:
+		dec, err := zstd.NewReader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dec.Close()
+		r = dec
+	}
+
+	decoded, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("cannot decode %s body - %s", encoding, err)
+	}
+	return string(decoded)
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	c, _ := newCompressor(&Compression{Algorithms: []string{"br", "zstd", "gzip"}})
+	tests := []struct {
+		accept, want string
+	}{
+		{"gzip, deflate, br", Brotli},
+		{"gzip, br;q=0.5", Gzip},
+		{"gzip;q=0, br;q=0", ""},
+		{"zstd, gzip", Zstd},
+		{"*", Brotli},
+		{"*, br;q=0", Zstd},
+		{"deflate", ""},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if got := c.negotiate(tt.accept); got != tt.want {
+			t.Errorf("'%s': expected '%s', got '%s'", tt.accept, tt.want, got)
+		}
+	}
+
+	if _, err := newCompressor(&Compression{Algorithms: []string{"lzma"}}); err == nil {
+		t.Errorf("unknown algorithm was accepted")
+	}
+}
+
+func TestCompression(t *testing.T) {
+	content := strings.Repeat("compressible content ", 200)
+	addr, stop := serverAddr(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		w.Header().Set("Etag", `"v1"`)
+		if r.URL.Query().Get("small") != "" {
+			w.Write([]byte("small"))
+			return
+		}
+		w.Write([]byte(content))
+	})
+	defer stop()
+	tr := testTransport(t, &Transport{compress: testCompressor(t, &Compression{})}, addr)
+
+	for _, encoding := range []string{Brotli, Zstd, Gzip} {
+		resp, body := cachedGet(t, tr, "GET", "http://example.com/?type=text/html", "Accept-Encoding", encoding)
+		if resp.Header.Get("Content-Encoding") != encoding {
+			t.Errorf("expected %s encoding, got '%s'", encoding, resp.Header.Get("Content-Encoding"))
+			continue
+		}
+		if len(body) >= len(content) || decode(t, encoding, body) != content {
+			t.Errorf("%s body was not compressed", encoding)
+		}
+		if resp.Header.Get("Vary") != "Accept-Encoding" || resp.Header.Get("Etag") != `W/"v1"` {
+			t.Errorf("%s response headers not updated - %v", encoding, resp.Header)
+		}
+	}
+
+	tests := []struct {
+		name, url, accept string
+	}{
+		{"type", "/?type=image/png", "gzip"},
+		{"small", "/?type=text/html&small=1", "gzip"},
+		{"not accepted", "/?type=text/html", "identity"},
+	}
+	for _, tt := range tests {
+		resp, _ := cachedGet(t, tr, "GET", "http://example.com"+tt.url, "Accept-Encoding", tt.accept)
+		if resp.Header.Get("Content-Encoding") != "" {
+			t.Errorf("%s: response was compressed", tt.name)
+		}
+	}
+}
+
+func TestRecompression(t *testing.T) {
+	content := strings.Repeat("compressible content ", 200)
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte(content))
+	w.Close()
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(gz.Bytes())
+	}
+
+	addr, stop := serverAddr(t, handler)
+	defer stop()
+
+	tr := testTransport(t, &Transport{compress: testCompressor(t, &Compression{})}, addr)
+	resp, body := cachedGet(t, tr, "GET", "http://example.com/", "Accept-Encoding", "br")
+	if resp.Header.Get("Content-Encoding") != Gzip || decode(t, Gzip, body) != content {
+		t.Errorf("compressed upstream response was changed")
+	}
+
+	tr = testTransport(t, &Transport{compress: testCompressor(t, &Compression{Recompress: true, MinSize: 10})}, addr)
+	resp, body = cachedGet(t, tr, "GET", "http://example.com/", "Accept-Encoding", "gzip, br")
+	if resp.Header.Get("Content-Encoding") != Brotli || decode(t, Brotli, body) != content {
+		t.Errorf("upstream gzip was not recompressed with brotli, got '%s'", resp.Header.Get("Content-Encoding"))
+	}
+
+	// a client only accepting what the upstream sent gets it unchanged
+	resp, body = cachedGet(t, tr, "GET", "http://example.com/", "Accept-Encoding", "gzip")
+	if resp.Header.Get("Content-Encoding") != Gzip || body != gz.String() {
+		t.Errorf("gzip response was recompressed for a gzip client")
+	}
+}
+
+func TestCompressionStreaming(t *testing.T) {
+	event := "data: " + strings.Repeat("x", 20) + "\n\n"
+	next := make(chan struct{})
+	addr, stop := serverAddr(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte(event))
+		w.(http.Flusher).Flush()
+		// the second event waits until the client has had the first
+		<-next
+		w.Write([]byte(event))
+	})
+	defer stop()
+	tr := testTransport(t, &Transport{compress: testCompressor(t, &Compression{Types: []string{"text/event-stream"}})}, addr)
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Encoding") != Gzip {
+		t.Fatalf("event stream was not compressed, got '%s'", resp.Header.Get("Content-Encoding"))
+	}
+
+	read := make(chan string)
+	go func() {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			read <- err.Error()
+			return
+		}
+		buf := make([]byte, len(event))
+		n, _ := io.ReadFull(gz, buf)
+		read <- string(buf[:n])
+	}()
+
+	select {
+	case got := <-read:
+		if got != event {
+			t.Errorf("expected the first event, got '%s'", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("first event was held back")
+	}
+	close(next)
+}
@@ -15,7 +15,8 @@ func (c *Context) Reset() {
 }
 
 func routingContext(ctx context.Context) *Context {
-	return ctx.Value(CtxKey).(*Context)
+	c, _ := ctx.Value(CtxKey).(*Context)
+	return c
 }
 
 func RouteParam(r *http.Request, key string) string {
@@ -1,11 +1,13 @@
 package liberty
 
 import (
-	"hash/fnv"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
 	"net/http"
-	"strconv"
-
-	"golang.scot/liberty/env"
+	"strings"
 )
 
 var DefaultTypes = []string{
@@ -17,41 +19,163 @@ var DefaultTypes = []string{
 	"text/plain",
 }
 
-func eTagMatch(req *http.Request, res *http.Response) bool {
-	if env.Get() != env.Prod {
-		return false
+// ResponseFilter is a rule for the responses of an upstream, the first rule
+// matching a response is applied. Types are content types such as "image/png"
+// or patterns such as "text/*", Paths are prefixes of the path the client
+// asked for, and a rule without either matches everything.
+//
+// CacheControl is set on successful responses which have none, or replaces
+// what the upstream sent with Override. With ETag, a strong ETag is made from
+// a hash of the body for a 200 without one, as long as the body is no bigger
+// than MaxETagBytes. Bodies of unknown length are read up to that size before
+// they are passed on.
+type ResponseFilter struct {
+	Types        []string `yaml:"types, flow"`
+	Paths        []string `yaml:"paths, flow"`
+	CacheControl string   `yaml:"cacheControl"`
+	Override     bool     `yaml:"override"`
+	ETag         bool     `yaml:"etag"`
+	MaxETagBytes int64    `yaml:"maxETagBytes"`
+}
+
+func (f *ResponseFilter) normalise() {
+	if f.MaxETagBytes <= 0 {
+		f.MaxETagBytes = 1 << 20
+	}
+	for i, t := range f.Types {
+		f.Types[i] = strings.ToLower(strings.TrimSpace(t))
+	}
+}
+
+// matches reports whether the rule applies to a response
+func (f *ResponseFilter) matches(path, contentType string) bool {
+	if len(f.Paths) > 0 {
+		matched := false
+		for _, prefix := range f.Paths {
+			if strings.HasPrefix(path, prefix) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if len(f.Types) == 0 {
+		return true
 	}
-	if if_none_match := req.Header.Get("If-None-Match"); if_none_match != "" {
-		if res.StatusCode == 200 && res.Header.Get("Etag") == if_none_match {
-			res.StatusCode = 304
-			res.Status = "304 Not Modified"
-			res.Body.Close()
-			res.ContentLength = 0
+	for _, t := range f.Types {
+		if typeMatches(t, contentType) {
 			return true
 		}
 	}
 	return false
 }
 
-func setEtag(res *http.Response) {
-	var contentType = res.Header.Get("Content-Type")
-	switch contentType {
-	case "text/css", "text/css; charset=UTF-8", "text/javascript", "application/javascript":
-		hash := fnv.New32a()
-		hash.Write([]byte(res.Request.URL.String()))
-		sum := hash.Sum32()
-		res.Header.Set("Etag", strconv.Itoa(int(sum)))
+// mediaType is the content type without its parameters
+func mediaType(contentType string) string {
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
 	}
+	return strings.ToLower(strings.TrimSpace(contentType))
 }
 
-func maxAge(res *http.Response) {
-	var contentType = res.Header.Get("Content-Type")
-	switch contentType {
-	case "text/html", "text/html; charset=UTF-8", "application/json", "text/xml":
-		res.Header.Set("Cache-Control", "no-store")
-	case "image/png", "image/jpeg", "image/gif":
-		res.Header.Set("Cache-Control", "public, max-age=2419200")
-	case "text/css", "text/css; charset=UTF-8", "text/javascript", "application/javascript":
-		res.Header.Set("Cache-Control", "public, max-age=2419200")
+// typeMatches compares a content type to a pattern, which may end in a
+// wildcard subtype or be "*" for any type
+func typeMatches(pattern, contentType string) bool {
+	pattern, contentType = mediaType(pattern), mediaType(contentType)
+	if pattern == "*" || pattern == "*/*" || pattern == contentType {
+		return true
 	}
+	return strings.HasSuffix(pattern, "/*") && strings.HasPrefix(contentType, pattern[:len(pattern)-1])
+}
+
+// responseFilter applies the filter rules of a proxy entry to the responses
+// from its upstream, and answers conditional requests from the result
+type responseFilter struct {
+	rules []*ResponseFilter
+}
+
+func newResponseFilter(rules []*ResponseFilter) *responseFilter {
+	for _, rule := range rules {
+		rule.normalise()
+	}
+	return &responseFilter{rules: rules}
+}
+
+// clientPath is the path the client asked for, before it was rewritten
+func clientPath(r *http.Request) string {
+	uri, ok := r.Context().Value(requestURIKey{}).(string)
+	if !ok {
+		return r.URL.Path
+	}
+	if i := strings.IndexByte(uri, '?'); i >= 0 {
+		uri = uri[:i]
+	}
+	return uri
+}
+
+// apply the first rule matching the response from the upstream
+func (rf *responseFilter) apply(r *http.Request, resp *http.Response) {
+	path, contentType := clientPath(r), resp.Header.Get("Content-Type")
+
+	var rule *ResponseFilter
+	for _, f := range rf.rules {
+		if f.matches(path, contentType) {
+			rule = f
+			break
+		}
+	}
+	if rule == nil || resp.StatusCode >= 400 {
+		return
+	}
+
+	if rule.CacheControl != "" && (rule.Override || resp.Header.Get("Cache-Control") == "") {
+		resp.Header.Set("Cache-Control", rule.CacheControl)
+	}
+
+	if rule.ETag && r.Method == "GET" && resp.StatusCode == http.StatusOK && resp.Header.Get("Etag") == "" {
+		setBodyETag(resp, rule.MaxETagBytes)
+	}
+}
+
+// setBodyETag hashes the body into a strong ETag, the body read is put back in
+// front of anything left so the response is passed on whole
+func setBodyETag(resp *http.Response, limit int64) {
+	if resp.ContentLength > limit {
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil || int64(len(body)) > limit {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return
+	}
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	sum := sha256.Sum256(body)
+	resp.Header.Set("Etag", `"`+hex.EncodeToString(sum[:16])+`"`)
+}
+
+// conditional turns a full response into a 304 if it meets the conditions of
+// the client's request
+func (rf *responseFilter) conditional(r *http.Request, resp *http.Response) {
+	if r.Method != "GET" && r.Method != "HEAD" || resp.StatusCode != http.StatusOK {
+		return
+	}
+	if !notModified(r, resp.Header) {
+		return
+	}
+
+	resp.Body.Close()
+	resp.Status = "304 " + http.StatusText(http.StatusNotModified)
+	resp.StatusCode = http.StatusNotModified
+	resp.Body = http.NoBody
+	resp.ContentLength = 0
+	resp.Header.Del("Content-Length")
 }
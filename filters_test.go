@@ -0,0 +1,149 @@
+package liberty
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTypeMatches(t *testing.T) {
+	tests := []struct {
+		pattern, contentType string
+		match                bool
+	}{
+		{"text/css", "text/css; charset=UTF-8", true},
+		{"text/css", "TEXT/CSS", true},
+		{"text/*", "text/html", true},
+		{"text/*", "application/javascript", false},
+		{"*", "image/png", true},
+		{"image/png", "image/pngx", false},
+		{"text/*", "", false},
+	}
+
+	for _, tt := range tests {
+		if typeMatches(tt.pattern, tt.contentType) != tt.match {
+			t.Errorf("'%s' matching '%s' should be %v", tt.pattern, tt.contentType, tt.match)
+		}
+	}
+}
+
+func TestResponseFilterCacheControl(t *testing.T) {
+	addr, stop := serverAddr(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		if cc := r.URL.Query().Get("cc"); cc != "" {
+			w.Header().Set("Cache-Control", cc)
+		}
+		if r.URL.Query().Get("missing") != "" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	defer stop()
+	tr := testTransport(t, &Transport{filters: newResponseFilter([]*ResponseFilter{
+		{Types: []string{"text/html"}, CacheControl: "no-store", Override: true},
+		{Paths: []string{"/static/"}, Types: []string{"image/*", "text/css"}, CacheControl: "public, max-age=2419200"},
+	})}, addr)
+
+	tests := []struct {
+		url, cc string
+	}{
+		{"/page?type=text/html%3B%20charset=UTF-8&cc=max-age=60", "no-store"},
+		{"/static/a.png?type=image/png", "public, max-age=2419200"},
+		{"/static/a.css?type=text/css&cc=max-age=60", "max-age=60"},
+		{"/static/a.png?type=image/png&missing=1", ""},
+		{"/a.png?type=image/png", ""},
+	}
+
+	for _, tt := range tests {
+		resp, _ := cachedGet(t, tr, "GET", "http://example.com"+tt.url)
+		if cc := resp.Header.Get("Cache-Control"); cc != tt.cc {
+			t.Errorf("%s: expected Cache-Control '%s', got '%s'", tt.url, tt.cc, cc)
+		}
+	}
+}
+
+func TestResponseFilterETag(t *testing.T) {
+	content := "body { color: red }"
+	addr, stop := serverAddr(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/css")
+		if r.URL.Path == "/big.css" {
+			w.Write(bytes.Repeat([]byte("a"), 100))
+			return
+		}
+		fmt.Fprint(w, content)
+	})
+	defer stop()
+	tr := testTransport(t, &Transport{filters: newResponseFilter([]*ResponseFilter{
+		{Types: []string{"text/css"}, ETag: true, MaxETagBytes: 64},
+	})}, addr)
+
+	resp, body := cachedGet(t, tr, "GET", "http://example.com/a.css")
+	etag := resp.Header.Get("Etag")
+	if !strings.HasPrefix(etag, `"`) || body != content {
+		t.Fatalf("expected a strong ETag and the whole body, got '%s' '%s'", etag, body)
+	}
+
+	resp, body = cachedGet(t, tr, "GET", "http://example.com/a.css", "If-None-Match", etag)
+	if resp.StatusCode != http.StatusNotModified || body != "" {
+		t.Errorf("expected 304 for a matching ETag, got %d", resp.StatusCode)
+	}
+
+	content = "body { color: blue }"
+	resp, body = cachedGet(t, tr, "GET", "http://example.com/a.css", "If-None-Match", etag)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Etag") == etag || body != content {
+		t.Errorf("ETag did not change with the content")
+	}
+
+	resp, body = cachedGet(t, tr, "GET", "http://example.com/big.css")
+	if resp.Header.Get("Etag") != "" || len(body) != 100 {
+		t.Errorf("body over the limit was given an ETag or cut short, got %d bytes", len(body))
+	}
+}
+
+func TestResponseFilterLastModified(t *testing.T) {
+	modified := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	addr, stop := serverAddr(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Last-Modified", modified.Format(http.TimeFormat))
+		fmt.Fprint(w, "content")
+	})
+	defer stop()
+	tr := testTransport(t, &Transport{filters: newResponseFilter([]*ResponseFilter{{}})}, addr)
+
+	resp, _ := cachedGet(t, tr, "GET", "http://example.com/", "If-Modified-Since", modified.Format(http.TimeFormat))
+	if resp.StatusCode != http.StatusNotModified {
+		t.Errorf("expected 304 when not modified since, got %d", resp.StatusCode)
+	}
+
+	resp, _ = cachedGet(t, tr, "GET", "http://example.com/", "If-Modified-Since", modified.Add(-time.Hour).Format(http.TimeFormat))
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200 when modified since, got %d", resp.StatusCode)
+	}
+}
+
+// a body hashed for an ETag is what the cache stores and revalidates with
+func TestResponseFilterCached(t *testing.T) {
+	calls := 0
+	tr, _, stop := cacheTransport(t, &Cache{}, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		fmt.Fprint(w, "content")
+	})
+	defer stop()
+	tr.filters = newResponseFilter([]*ResponseFilter{{CacheControl: "max-age=60", ETag: true}})
+
+	resp, _ := cachedGet(t, tr, "GET", "http://example.com/")
+	etag := resp.Header.Get("Etag")
+
+	resp, body := cachedGet(t, tr, "GET", "http://example.com/")
+	if resp.Header.Get("X-Cache") != cacheHit || resp.Header.Get("Etag") != etag || body != "content" {
+		t.Errorf("filtered response was not cached")
+	}
+	resp, _ = cachedGet(t, tr, "GET", "http://example.com/", "If-None-Match", etag)
+	if resp.StatusCode != http.StatusNotModified {
+		t.Errorf("expected 304 from the cache, got %d", resp.StatusCode)
+	}
+	if calls != 1 {
+		t.Errorf("expected one upstream request, got %d", calls)
+	}
+}
@@ -0,0 +1,142 @@
+package liberty
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"golang.scot/liberty/middleware"
+)
+
+var trustedProxies = middleware.TrustedProxies{Nets: middleware.IPs2nets([]string{"10.0.0.0/8"})}
+
+var trustedForwarded = middleware.TrustedProxies{Nets: trustedProxies.Nets, Header: middleware.Forwarded}
+
+var clientIPTests = []struct {
+	trusted   middleware.TrustedProxies
+	remote    string
+	xff       string
+	forwarded string
+	client    string
+}{
+	// forwarding headers from an untrusted peer are ignored
+	{trustedProxies, "192.0.2.1:1234", "203.0.113.9", "", "192.0.2.1"},
+	{trustedProxies, "10.0.0.1:1234", "", "", "10.0.0.1"},
+	{trustedProxies, "10.0.0.1:1234", "203.0.113.9", "", "203.0.113.9"},
+	// the right most untrusted address is the client, not the first
+	{trustedProxies, "10.0.0.1:1234", "198.51.100.7, 203.0.113.9, 10.0.0.2", "", "203.0.113.9"},
+	{trustedProxies, "10.0.0.1:1234", "10.0.0.3, 10.0.0.2", "", "10.0.0.3"},
+	// only the header the trusted proxies maintain is believed, a client
+	// can send the other with any address
+	{trustedProxies, "10.0.0.1:1234", "198.51.100.7", `for=192.168.1.1`, "198.51.100.7"},
+	{trustedProxies, "10.0.0.1:1234", "198.51.100.7", `for=203.0.113.9;proto=https, for="10.0.0.2:8080"`, "198.51.100.7"},
+	{trustedForwarded, "10.0.0.1:1234", "192.168.1.1", `for=203.0.113.9;proto=https, for="10.0.0.2:8080"`, "203.0.113.9"},
+	{trustedForwarded, "10.0.0.1:1234", "", `for="[2001:db8::1]:4711"`, "2001:db8::1"},
+	{trustedForwarded, "10.0.0.1:1234", "192.168.1.1", "", "10.0.0.1"},
+}
+
+func TestClientIP(t *testing.T) {
+	for _, test := range clientIPTests {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.RemoteAddr = test.remote
+		if test.xff != "" {
+			req.Header.Set("X-Forwarded-For", test.xff)
+		}
+		if test.forwarded != "" {
+			req.Header.Set("Forwarded", test.forwarded)
+		}
+
+		ip, err := test.trusted.ClientIP(req)
+		if err != nil {
+			t.Errorf("%s via %s - %s", test.xff, test.remote, err)
+			continue
+		}
+		if ip.String() != test.client {
+			t.Errorf("%s%s via %s - expected client '%s', got '%s'", test.xff, test.forwarded, test.remote, test.client, ip)
+		}
+	}
+}
+
+func TestClientIPObfuscated(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("Forwarded", "for=_hidden")
+
+	if _, err := trustedForwarded.ClientIP(req); err == nil {
+		t.Error("expected an error for an obfuscated client address")
+	}
+}
+
+var setForwardedTests = []struct {
+	trusted   middleware.TrustedProxies
+	remote    string
+	xff       string
+	forwarded string
+	host      string
+	expXFF    string
+	expFwd    string
+	expHost   string
+}{
+	{trustedProxies, "192.0.2.1:1234", "6.6.6.6, 192.0.2.1", "for=6.6.6.6", "", "192.0.2.1", `for=192.0.2.1;host="example.com";proto=https`, "example.com"},
+	{trustedProxies, "10.0.0.1:1234", "10.0.0.1", "", "", "10.0.0.1", `for=10.0.0.1;host="example.com";proto=https`, "example.com"},
+	// the Forwarded header is rebuilt from X-Forwarded-For, not passed on
+	{trustedProxies, "10.0.0.1:1234", "203.0.113.9, 10.0.0.1", "for=192.168.1.1", "origin.example.com", "203.0.113.9, 10.0.0.1", `for=203.0.113.9, for=10.0.0.1;host="example.com";proto=https`, "origin.example.com"},
+	// and X-Forwarded-For from Forwarded when that is the one maintained
+	{trustedForwarded, "10.0.0.1:1234", "192.168.1.1, 10.0.0.1", `for=203.0.113.9;proto=https`, "", "203.0.113.9, 10.0.0.1", `for=203.0.113.9;proto=https, for=10.0.0.1;host="example.com";proto=https`, "example.com"},
+}
+
+func TestSetForwarded(t *testing.T) {
+	for _, test := range setForwardedTests {
+		tr := &Transport{trusted: test.trusted}
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.RemoteAddr = test.remote
+		req.Header.Set("X-Forwarded-For", test.xff)
+		if test.forwarded != "" {
+			req.Header.Set("Forwarded", test.forwarded)
+		}
+		if test.host != "" {
+			req.Header.Set("X-Forwarded-Host", test.host)
+		}
+
+		tr.setForwarded(req)
+
+		if xff := req.Header.Get("X-Forwarded-For"); xff != test.expXFF {
+			t.Errorf("X-Forwarded-For via %s - expected '%s', got '%s'", test.remote, test.expXFF, xff)
+		}
+		if fwd := req.Header.Get("Forwarded"); fwd != test.expFwd {
+			t.Errorf("Forwarded via %s - expected '%s', got '%s'", test.remote, test.expFwd, fwd)
+		}
+		if host := req.Header.Get("X-Forwarded-Host"); host != test.expHost {
+			t.Errorf("X-Forwarded-Host via %s - expected '%s', got '%s'", test.remote, test.expHost, host)
+		}
+		if proto := req.Header.Get("X-Forwarded-Proto"); proto != "https" {
+			t.Errorf("X-Forwarded-Proto via %s - expected 'https', got '%s'", test.remote, proto)
+		}
+	}
+}
+
+func TestTrustedProxiesConfig(t *testing.T) {
+	conf := &Config{TrustedProxies: []string{"10.0.0.1", "2001:db8::1", "192.168.0.0/16"}, ForwardedHeader: "forwarded"}
+	tp, err := conf.trustedProxies()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tp.Forwarded() {
+		t.Errorf("expected the Forwarded header to be maintained, got '%s'", tp.Header)
+	}
+	for ip, trusted := range map[string]bool{"10.0.0.1": true, "10.0.0.2": false, "2001:db8::1": true, "192.168.4.4": true} {
+		if tp.Contains(net.ParseIP(ip)) != trusted {
+			t.Errorf("expected %s trusted to be %t", ip, trusted)
+		}
+	}
+
+	for _, conf := range []*Config{
+		{TrustedProxies: []string{"10.0.0.300"}},
+		{TrustedProxies: []string{"10.0.0.0/33"}},
+		{ForwardedHeader: "X-Real-IP"},
+	} {
+		if _, err := conf.trustedProxies(); err == nil {
+			t.Errorf("expected an error for %v", conf)
+		}
+	}
+}
@@ -2,12 +2,14 @@ module golang.scot/liberty
 
 require (
 	github.com/NYTimes/gziphandler v1.0.1
+	github.com/andybalholm/brotli v1.0.0
 	github.com/beorn7/perks v0.0.0-20180321164747-3a771d992973
 	github.com/coreos/go-systemd v0.0.0-20180525142239-a4887aeaa186
 	github.com/gnanderson/trie v0.0.0-20120416205854-d1ee10f3b6eb
 	github.com/golang/protobuf v1.1.0
 	github.com/gorilla/websocket v1.2.0
 	github.com/kavu/go_reuseport v1.3.0
+	github.com/klauspost/compress v1.10.3
 	github.com/koding/websocketproxy v0.0.0-20180518005506-944ae4ae170f
 	github.com/matttproud/golang_protobuf_extensions v1.0.1
 	github.com/pkg/errors v0.8.0
@@ -16,6 +18,6 @@ require (
 	github.com/prometheus/client_model v0.0.0-20171117100541-99fa1f4be8e5
 	github.com/prometheus/common v0.0.0-20180518154759-7600349dcfe1
 	github.com/prometheus/procfs v0.0.0-20180601124529-94663424ae5a
-	golang.org/x/crypto v0.0.0-20180608092829-8ac0e0d97ce4
-	golang.org/x/net v0.0.0-20180611182652-db08ff08e862
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
+	golang.org/x/net v0.0.0-20211112202133-69e39bad7dc2
 )
@@ -0,0 +1,154 @@
+package liberty
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+
+	"golang.scot/liberty/middleware"
+)
+
+// Header is a header name and value for a header rewrite rule. The value may
+// be a template with access to the request, for example
+//
+//	{{ .ClientIP }}, {{ .Host }}, {{ .RequestID }}, {{ .Param "id" }} or
+//	{{ .Header "User-Agent" }}
+type Header struct {
+	Name  string `yaml:"name"`
+	Value string `yaml:"value"`
+}
+
+// HeaderRules are applied in order: headers are removed, then set, replacing
+// any existing values, and finally appended to.
+type HeaderRules struct {
+	Remove []string  `yaml:"remove, flow"`
+	Set    []*Header `yaml:"set"`
+	Append []*Header `yaml:"append"`
+}
+
+const requestIDHeader = "X-Request-Id"
+
+// headerData is what templated header values are executed against
+type headerData struct {
+	r       *http.Request
+	trusted middleware.TrustedProxies
+}
+
+// ClientIP is the address of the client, as reported by any trusted proxies
+func (d headerData) ClientIP() string {
+	ip, err := d.trusted.ClientIP(d.r)
+	if err != nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// Host is the host the request was made to
+func (d headerData) Host() string {
+	return d.r.Host
+}
+
+// RequestID is the ID of the request, generated and added to the forwarded
+// request if the client did not send one
+func (d headerData) RequestID() string {
+	return requestID(d.r)
+}
+
+// Param is the value of a parameter matched by the route
+func (d headerData) Param(name string) string {
+	return RouteParam(d.r, name)
+}
+
+// Header is the value of a request header
+func (d headerData) Header(name string) string {
+	return d.r.Header.Get(name)
+}
+
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(requestIDHeader); id != "" {
+		return id
+	}
+
+	b := make([]byte, 16)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+	r.Header.Set(requestIDHeader, id)
+
+	return id
+}
+
+type headerValue struct {
+	name  string
+	value string
+	tpl   *template.Template
+}
+
+func (hv *headerValue) execute(d headerData) string {
+	if hv.tpl == nil {
+		return hv.value
+	}
+
+	var buf bytes.Buffer
+	if err := hv.tpl.Execute(&buf, d); err != nil {
+		return ""
+	}
+
+	return buf.String()
+}
+
+// headerRewriter applies a set of header rules to request or response headers
+type headerRewriter struct {
+	remove  []string
+	set     []*headerValue
+	append  []*headerValue
+	trusted middleware.TrustedProxies
+}
+
+func newHeaderRewriter(rules *HeaderRules, trusted middleware.TrustedProxies) (*headerRewriter, error) {
+	hr := &headerRewriter{remove: rules.Remove, trusted: trusted}
+
+	var err error
+	if hr.set, err = headerValues(rules.Set); err != nil {
+		return nil, err
+	}
+	if hr.append, err = headerValues(rules.Append); err != nil {
+		return nil, err
+	}
+
+	return hr, nil
+}
+
+func headerValues(headers []*Header) ([]*headerValue, error) {
+	values := make([]*headerValue, len(headers))
+	for i, h := range headers {
+		hv := &headerValue{name: h.Name, value: h.Value}
+		if strings.Contains(h.Value, "{{") {
+			tpl, err := template.New(h.Name).Parse(h.Value)
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse value for header '%s' - %s", h.Name, err)
+			}
+			hv.tpl = tpl
+		}
+		values[i] = hv
+	}
+
+	return values, nil
+}
+
+// apply the rules to the headers h, templates are executed against r
+func (hr *headerRewriter) apply(h http.Header, r *http.Request) {
+	d := headerData{r: r, trusted: hr.trusted}
+	for _, name := range hr.remove {
+		h.Del(name)
+	}
+	for _, hv := range hr.set {
+		h.Set(hv.name, hv.execute(d))
+	}
+	for _, hv := range hr.append {
+		h.Add(hv.name, hv.execute(d))
+	}
+}
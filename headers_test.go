@@ -0,0 +1,85 @@
+package liberty
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.scot/liberty/middleware"
+)
+
+func TestHeaderRules(t *testing.T) {
+	hr, err := newHeaderRewriter(&HeaderRules{
+		Remove: []string{"X-Remove"},
+		Set: []*Header{
+			{Name: "X-Static", Value: "static"},
+			{Name: "X-Client", Value: "{{ .ClientIP }}"},
+			{Name: "X-Host", Value: "{{ .Host }}"},
+			{Name: "X-User", Value: "{{ .Param \"user\" }}"},
+			{Name: "X-Agent", Value: "agent={{ .Header \"User-Agent\" }}"},
+		},
+		Append: []*Header{
+			{Name: "X-Multi", Value: "two"},
+		},
+	}, middleware.TrustedProxies{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "http://example.com/users/bob", nil)
+	req.RemoteAddr = "192.0.2.1:4321"
+	req.Header.Set("User-Agent", "test")
+	req = req.WithContext(context.WithValue(req.Context(), CtxKey, &Context{Params: Params{{"user", "bob"}}}))
+
+	h := http.Header{}
+	h.Set("X-Remove", "gone")
+	h.Set("X-Multi", "one")
+	hr.apply(h, req)
+
+	expected := map[string]string{
+		"X-Remove": "",
+		"X-Static": "static",
+		"X-Client": "192.0.2.1",
+		"X-Host":   "example.com",
+		"X-User":   "bob",
+		"X-Agent":  "agent=test",
+	}
+	for name, value := range expected {
+		if h.Get(name) != value {
+			t.Errorf("header '%s' - expected '%s', got '%s'", name, value, h.Get(name))
+		}
+	}
+	if multi := h["X-Multi"]; len(multi) != 2 || multi[1] != "two" {
+		t.Errorf("header value not appended - %v", multi)
+	}
+}
+
+func TestHeaderRequestID(t *testing.T) {
+	hr, err := newHeaderRewriter(&HeaderRules{
+		Set: []*Header{{Name: "X-Trace", Value: "{{ .RequestID }}"}},
+	}, middleware.TrustedProxies{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	resp := http.Header{}
+	hr.apply(req.Header, req)
+	hr.apply(resp, req)
+
+	id := req.Header.Get(requestIDHeader)
+	if len(id) != 32 {
+		t.Fatalf("expected a generated request ID, got '%s'", id)
+	}
+	if req.Header.Get("X-Trace") != id || resp.Get("X-Trace") != id {
+		t.Error("request ID differs between request and response")
+	}
+}
+
+func TestHeaderInvalidTemplate(t *testing.T) {
+	_, err := newHeaderRewriter(&HeaderRules{Set: []*Header{{Name: "X-Bad", Value: "{{ .Nope"}}}, middleware.TrustedProxies{})
+	if err == nil {
+		t.Error("expected an error for an invalid header template")
+	}
+}
@@ -0,0 +1,196 @@
+package liberty
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Health check types, an HTTP check requests the configured path from each
+// upstream and compares the status, a TCP check only needs the connection to
+// be accepted.
+const (
+	HTTPCheck = "http"
+	TCPCheck  = "tcp"
+)
+
+// HealthCheck configures active checking of each member in an upstream pool.
+// Members failing the check Unhealthy times in a row are removed from
+// selection until they have passed Healthy times in a row. Checks connect the
+// way proxied requests do, so with the PROXY protocol each check sends a
+// header without a client address, v1 UNKNOWN or a v2 LOCAL command, and HTTP
+// checks of an h2 or h2c upstream are made over HTTP/2.
+type HealthCheck struct {
+	Type      string        `yaml:"type"`
+	Path      string        `yaml:"path"`
+	Status    int           `yaml:"status"`
+	Interval  time.Duration `yaml:"interval"`
+	Timeout   time.Duration `yaml:"timeout"`
+	Healthy   int           `yaml:"healthyThreshold"`
+	Unhealthy int           `yaml:"unhealthyThreshold"`
+}
+
+// set defaults for anything left out of the config
+func (hc *HealthCheck) normalise() {
+	if hc.Type == "" {
+		hc.Type = HTTPCheck
+	}
+	if hc.Path == "" {
+		hc.Path = "/"
+	}
+	if hc.Status == 0 {
+		hc.Status = http.StatusOK
+	}
+	if hc.Interval <= 0 {
+		hc.Interval = 10 * time.Second
+	}
+	if hc.Timeout <= 0 {
+		hc.Timeout = 2 * time.Second
+	}
+	if hc.Healthy <= 0 {
+		hc.Healthy = 2
+	}
+	if hc.Unhealthy <= 0 {
+		hc.Unhealthy = 3
+	}
+}
+
+// healthChecker periodically checks every member of a pool
+type healthChecker struct {
+	conf   *HealthCheck
+	pool   *pool
+	scheme string
+	host   string
+	dial   dialFunc
+	client *http.Client
+}
+
+// newHealthChecker checks the members of the pool, connecting the way the
+// upstream does or with plain TCP and HTTP/1.1 if it is nil
+func newHealthChecker(conf *HealthCheck, p *pool, scheme, host string, tlsConfig *tls.Config, u *Upstream) *healthChecker {
+	conf.normalise()
+	p.recheck = conf.Interval
+
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{ServerName: host}
+	}
+	dial := (&net.Dialer{}).DialContext
+	if u != nil {
+		dial = u.dialer()
+	}
+
+	var transport http.RoundTripper = &http.Transport{
+		DialContext:       dial,
+		TLSClientConfig:   tlsConfig,
+		DisableKeepAlives: true,
+	}
+	if u != nil && (u.Protocol == H2 || u.Protocol == H2C) {
+		transport = u.transport(tlsConfig)
+	}
+
+	return &healthChecker{
+		conf:   conf,
+		pool:   p,
+		scheme: scheme,
+		host:   host,
+		dial:   dial,
+		client: &http.Client{
+			Timeout:   conf.Timeout,
+			Transport: transport,
+			// the status of the upstream itself is what we are checking
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// run checks the pool immediately and then on every interval until the pool
+// is closed
+func (hc *healthChecker) run() {
+	ticker := time.NewTicker(hc.conf.Interval)
+	defer ticker.Stop()
+
+	for {
+		hc.checkAll()
+
+		select {
+		case <-hc.pool.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (hc *healthChecker) checkAll() {
+	var wg sync.WaitGroup
+	for _, m := range hc.pool.all() {
+		wg.Add(1)
+		go func(m *member) {
+			defer wg.Done()
+			hc.observe(m, hc.check(m))
+		}(m)
+	}
+	wg.Wait()
+}
+
+func (hc *healthChecker) check(m *member) error {
+	if hc.conf.Type == TCPCheck {
+		ctx, cancel := context.WithTimeout(context.Background(), hc.conf.Timeout)
+		defer cancel()
+		conn, err := hc.dial(ctx, "tcp", m.addr.String())
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s://%s%s", hc.scheme, m.addr, hc.conf.Path), nil)
+	if err != nil {
+		return err
+	}
+	req.Host = hc.host
+	req.Header.Set("User-Agent", "Liberty health check")
+
+	resp, err := hc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != hc.conf.Status {
+		return fmt.Errorf("unexpected status %d, expected %d", resp.StatusCode, hc.conf.Status)
+	}
+
+	return nil
+}
+
+// observe records the result of a check against a member, flipping its state
+// once a threshold is crossed. The counters are only touched by the checker.
+func (hc *healthChecker) observe(m *member, err error) {
+	if err == nil {
+		m.failures = 0
+		m.successes++
+		if !m.healthy() && m.successes >= hc.conf.Healthy {
+			log.Printf("upstream %s for '%s' is healthy", m, hc.pool.name)
+			m.setHealthy(true)
+		}
+	} else {
+		m.successes = 0
+		m.failures++
+		if m.healthy() && m.failures >= hc.conf.Unhealthy {
+			log.Printf("upstream %s for '%s' is unhealthy - %s", m, hc.pool.name, err)
+			m.setHealthy(false)
+		}
+	}
+
+	upstreamUp.WithLabelValues(hc.pool.name, m.String()).Set(boolGauge(m.healthy()))
+}
@@ -0,0 +1,138 @@
+package liberty
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthCheckThresholds(t *testing.T) {
+	var status int32 = http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			t.Errorf("unexpected health check path '%s'", r.URL.Path)
+		}
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	addr, _ := net.ResolveTCPAddr("tcp", u.Host)
+
+	p, err := newPool("test", RoundRobin, nil, []*net.TCPAddr{addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc := newHealthChecker(&HealthCheck{Path: "/healthz", Healthy: 2, Unhealthy: 2}, p, "http", "example.com", nil, nil)
+	m := p.members[0]
+
+	atomic.StoreInt32(&status, http.StatusServiceUnavailable)
+	hc.checkAll()
+	if !m.healthy() {
+		t.Fatal("member marked unhealthy before reaching the threshold")
+	}
+	hc.checkAll()
+	if m.healthy() {
+		t.Fatal("member still healthy after reaching the unhealthy threshold")
+	}
+	if p.next() != nil {
+		t.Fatal("unhealthy member was selected")
+	}
+
+	atomic.StoreInt32(&status, http.StatusOK)
+	hc.checkAll()
+	if m.healthy() {
+		t.Fatal("member marked healthy before reaching the threshold")
+	}
+	hc.checkAll()
+	if !m.healthy() {
+		t.Fatal("member still unhealthy after reaching the healthy threshold")
+	}
+	if p.next() != m {
+		t.Fatal("healthy member was not selected")
+	}
+}
+
+func TestHealthCheckTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().(*net.TCPAddr)
+
+	p, err := newPool("test", RoundRobin, nil, []*net.TCPAddr{addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc := newHealthChecker(&HealthCheck{Type: TCPCheck, Unhealthy: 1}, p, "http", "example.com", nil, nil)
+
+	if err := hc.check(p.members[0]); err != nil {
+		t.Errorf("tcp check failed against a listening socket - %s", err)
+	}
+
+	ln.Close()
+	hc.checkAll()
+	if p.members[0].healthy() {
+		t.Error("member still healthy after the listener closed")
+	}
+}
+
+func TestHealthCheckProxyProtocol(t *testing.T) {
+	for _, version := range []int{1, 2} {
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		pp, err := newProxyProtocol(&ProxyProtocol{Trusted: []string{"127.0.0.1"}, Timeout: time.Second})
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv.Listener = proxyProtoListener{srv.Listener, pp}
+		srv.Start()
+
+		p, err := newPool("test", RoundRobin, nil, []*net.TCPAddr{srv.Listener.Addr().(*net.TCPAddr)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		u := &Upstream{ProxyProtocol: version}
+		u.normalise()
+		hc := newHealthChecker(&HealthCheck{Timeout: time.Second}, p, "http", "example.com", nil, u)
+		if err := hc.check(p.members[0]); err != nil {
+			t.Errorf("v%d check failed against an upstream requiring the PROXY protocol - %s", version, err)
+		}
+
+		hc = newHealthChecker(&HealthCheck{Timeout: time.Second}, p, "http", "example.com", nil, nil)
+		if err := hc.check(p.members[0]); err == nil {
+			t.Errorf("v%d check passed without sending a PROXY protocol header", version)
+		}
+		srv.Close()
+	}
+}
+
+func TestHealthCheckH2C(t *testing.T) {
+	addr, stop := serveH2C(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			w.WriteHeader(http.StatusHTTPVersionNotSupported)
+		}
+	}))
+	defer stop()
+
+	p, err := newPool("test", RoundRobin, nil, []*net.TCPAddr{addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u := &Upstream{Protocol: H2C}
+	u.normalise()
+	hc := newHealthChecker(&HealthCheck{Timeout: time.Second}, p, "http", "example.com", nil, u)
+	if err := hc.check(p.members[0]); err != nil {
+		t.Errorf("check failed against an h2c upstream - %s", err)
+	}
+
+	hc = newHealthChecker(&HealthCheck{Timeout: time.Second}, p, "http", "example.com", nil, nil)
+	if err := hc.check(p.members[0]); err == nil {
+		t.Error("HTTP/1.1 check passed against an h2c only upstream")
+	}
+}
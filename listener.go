@@ -1,23 +1,28 @@
 package liberty
 
 import (
-	"crypto/ecdsa"
-	"crypto/elliptic"
-	"crypto/rand"
 	"crypto/tls"
-	"log"
 	"net"
-	"os"
-	"strings"
 	"time"
 
 	"golang.org/x/crypto/acme"
-	"golang.org/x/crypto/acme/autocert"
-	"golang.scot/liberty/env"
 
 	reuseport "github.com/kavu/go_reuseport"
 )
 
+// ListenerConfig configures the socket liberty accepts connections on for an
+// address, such as "0.0.0.0:443". TLS chooses whether the address serves TLS
+// and proxies requests, or plain HTTP which only answers http-01 challenges
+// and redirects to https. Left out, proxy entries serve plain HTTP on port 80
+// and TLS on their hostPort. An address no proxy entry is served on, such as
+// ":8080" with port 80 forwarded to it, is listened on as well and has to set
+// TLS.
+type ListenerConfig struct {
+	Addr          string         `yaml:"addr"`
+	TLS           *bool          `yaml:"tls"`
+	ProxyProtocol *ProxyProtocol `yaml:"proxyProtocol"`
+}
+
 // Listener listens on the standard TLS port (443) on all interfaces
 // and returns a net.Listener returning *tls.Conn connections.
 //
@@ -25,29 +30,28 @@ import (
 // connections. The returned *tls.Conn are returned before their TLS
 // handshake has completed.
 //
-// Unlike NewListener, it is the caller's responsibility to initialize
-// the Manager m's Prompt, Cache, HostPolicy, and other desired options.
-func (s *server) Listener(domains []string) net.Listener {
-	// Lets Encrypt!
-	m := &autocert.Manager{
-		Client:     newAcmeClient(),
-		Cache:      autocert.DirCache(os.Getenv("ACME_CACHE")),
-		Email:      os.Getenv("ACME_EMAIL"),
-		Prompt:     autocert.AcceptTOS,
-		HostPolicy: autocert.HostWhitelist(domains...),
-	}
-
-	h := m.HTTPHandler(nil)
-	if strings.HasSuffix(s.s.Addr, ":80") {
-		s.handler = h
-		s.s.Handler = h
+// Certificates are chosen by the selector, which is shared by all servers.
+func (s *server) Listener(certs *certSelector) net.Listener {
+	nextProtos := []string{"h2", "http/1.1"}
+	if certs.acme != nil && certs.challenges.any(TLSALPN01) {
+		nextProtos = append(nextProtos, acme.ALPNProto)
 	}
 
 	config := &tls.Config{
 		MinVersion:               tls.VersionTLS12,
 		PreferServerCipherSuites: true,
-		NextProtos:               []string{"h2", "http/1.1"},
-		GetCertificate:           m.GetCertificate,
+		NextProtos:               nextProtos,
+		GetCertificate:           certs.GetCertificate,
+	}
+
+	// the certificate is verified by the proxy entry the request is for
+	withClientCerts := config.Clone()
+	withClientCerts.ClientAuth = tls.RequestClientCert
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if certs.clientCerts(hello.ServerName) {
+			return withClientCerts, nil
+		}
+		return nil, nil
 	}
 
 	ln := &listener{
@@ -88,8 +92,15 @@ func (ln *listener) Accept() (net.Conn, error) {
 
 	var finalConn net.Conn
 	finalConn = tcpConn
-	if strings.HasSuffix(ln.s.s.Addr, ":443") {
-		finalConn = tls.Server(tcpConn, ln.config)
+
+	// the client address from a PROXY protocol header has to be in place
+	// before the TLS handshake, so it is seen in handshake errors too
+	if ln.s.proxyProto != nil {
+		finalConn = ln.s.proxyProto.wrap(finalConn)
+	}
+
+	if ln.s.secure {
+		finalConn = tls.Server(finalConn, ln.config)
 	}
 	return finalConn, nil
 }
@@ -109,17 +120,3 @@ func (ln *listener) Close() error {
 	}
 	return ln.tcpListener.Close()
 }
-
-func newAcmeClient() *acme.Client {
-	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-	if err != nil {
-		log.Fatal(err)
-	}
-	client := &acme.Client{Key: key}
-
-	if env.Get() != env.Prod {
-		client.DirectoryURL = letsEncryptSandboxUrl
-	}
-
-	return client
-}
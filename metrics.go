@@ -0,0 +1,57 @@
+package liberty
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	upstreamUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "liberty",
+		Name:      "upstream_up",
+		Help:      "Whether an upstream pool member is passing its health checks.",
+	}, []string{"proxy", "addr"})
+
+	upstreamEjections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "liberty",
+		Name:      "upstream_ejections_total",
+		Help:      "Number of times an upstream pool member was ejected by outlier detection.",
+	}, []string{"proxy", "addr"})
+
+	ocspStapleValid = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "liberty",
+		Name:      "ocsp_staple_valid",
+		Help:      "Whether a certificate has a current OCSP response to staple.",
+	}, []string{"name"})
+
+	ocspStapleExpiry = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "liberty",
+		Name:      "ocsp_staple_next_update_timestamp_seconds",
+		Help:      "When the stapled OCSP response for a certificate expires.",
+	}, []string{"name"})
+
+	ocspFetchErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "liberty",
+		Name:      "ocsp_fetch_errors_total",
+		Help:      "Number of failed attempts to fetch an OCSP response.",
+	}, []string{"name"})
+
+	rateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "liberty",
+		Name:      "rate_limited_total",
+		Help:      "Number of requests refused by a rate limit.",
+	}, []string{"proxy", "path"})
+)
+
+func init() {
+	prometheus.MustRegister(upstreamUp)
+	prometheus.MustRegister(upstreamEjections)
+	prometheus.MustRegister(ocspStapleValid)
+	prometheus.MustRegister(ocspStapleExpiry)
+	prometheus.MustRegister(ocspFetchErrors)
+	prometheus.MustRegister(rateLimited)
+}
+
+func boolGauge(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
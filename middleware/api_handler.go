@@ -1,12 +1,11 @@
 package middleware
 
 import (
+	"fmt"
 	"net"
 	"net/http"
 	"strings"
 
-	"golang.scot/liberty/env"
-
 	"github.com/gnanderson/trie"
 )
 
@@ -68,6 +67,7 @@ func (a *whitelistEntry) allows(ip net.IP) bool {
 // being an IPRestrictedHandler
 type ApiHandler struct {
 	whitelist *trie.Trie
+	Trusted   TrustedProxies
 }
 
 // NewApiHandler builds a gated whitelist access handler
@@ -83,7 +83,6 @@ func NewApiHandler(whitelist []*ApiWhitelist) *ApiHandler {
 }
 
 func (ah *ApiHandler) Chain(h http.Handler) http.Handler {
-	appEnv := env.Get()
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// if url path is a sub path of a whitelisted prefex e.g. the path is
 		// /api/foo/bar and the whitelist contains /api/foo then this will be
@@ -99,7 +98,7 @@ func (ah *ApiHandler) Chain(h http.Handler) http.Handler {
 				}
 
 				// check further IP/host restrictions
-				if remoteIP, err := parseForwarderIP(r, appEnv); err == nil {
+				if remoteIP, err := ah.Trusted.ClientIP(r); err == nil {
 					if awl.allows(remoteIP) {
 						h.ServeHTTP(w, r)
 						return
@@ -125,3 +124,28 @@ func IPs2nets(ips []string) []*net.IPNet {
 	}
 	return nets
 }
+
+// ParseNets converts a list of networks in CIDR format to IPNets, a bare IP
+// address is a network of its own. Unlike IPs2nets a bad entry is returned as
+// an error.
+func ParseNets(addrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0)
+	for _, addr := range addrs {
+		addr = strings.TrimSpace(addr)
+		if ip := net.ParseIP(addr); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(addr)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse network '%s' - an IP address or CIDR is needed", addr)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
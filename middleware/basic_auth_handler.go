@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"os"
@@ -25,14 +26,59 @@ func hasher(s string) []byte {
 var userHash = hasher(os.Getenv("LIBERTY_USER"))
 var passHash = hasher(os.Getenv("LIBERTY_PASS"))
 
-func BasicAuthHandler(handler http.Handler) http.Handler {
+// BasicAuth protects a handler with a user name and password, either of its
+// own or the LIBERTY_USER and LIBERTY_PASS of the proxied vhosts
+type BasicAuth struct {
+	userHash []byte
+	passHash []byte
+}
+
+// NewBasicAuth returns a BasicAuth checking requests against the user and pass
+func NewBasicAuth(user, pass string) *BasicAuth {
+	return &BasicAuth{userHash: hasher(user), passHash: hasher(pass)}
+}
+
+var envAuth = &BasicAuth{userHash: userHash, passHash: passHash}
+
+// EnvBasicAuth checks the LIBERTY_USER and LIBERTY_PASS of the proxied vhosts,
+// as BasicAuthHandler does
+func EnvBasicAuth() *BasicAuth {
+	return envAuth
+}
+
+type basicAuthUserKey struct{}
+
+type verifiedUser struct {
+	auth *BasicAuth
+	user string
+}
+
+// Verify checks the credentials of the request, returning it with the user
+// recorded so that the handler of the same BasicAuth doesn't check them again
+func (ba *BasicAuth) Verify(r *http.Request) (*http.Request, string, bool) {
+	if v, ok := r.Context().Value(basicAuthUserKey{}).(verifiedUser); ok && v.auth == ba {
+		return r, v.user, true
+	}
+
+	user, pass, ok := r.BasicAuth()
+	if !ok || bcrypt.CompareHashAndPassword(ba.userHash, []byte(user)) != nil || bcrypt.CompareHashAndPassword(ba.passHash, []byte(pass)) != nil {
+		return r, "", false
+	}
+	return r.WithContext(context.WithValue(r.Context(), basicAuthUserKey{}, verifiedUser{auth: ba, user: user})), user, true
+}
+
+func (ba *BasicAuth) Chain(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		user, pass, ok := r.BasicAuth()
-		if !ok || bcrypt.CompareHashAndPassword(userHash, []byte(user)) != nil || bcrypt.CompareHashAndPassword(passHash, []byte(pass)) != nil {
+		r, _, ok := ba.Verify(r)
+		if !ok {
 			w.Header().Set("WWW-Authenticate", `Basic realm=Username and Password`)
 			http.Error(w, "Unauthorized.", http.StatusUnauthorized)
 			return
 		}
-		handler.ServeHTTP(w, r)
+		h.ServeHTTP(w, r)
 	})
 }
+
+func BasicAuthHandler(handler http.Handler) http.Handler {
+	return envAuth.Chain(handler)
+}
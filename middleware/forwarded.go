@@ -0,0 +1,173 @@
+package middleware
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var errForwardedAddr = errors.New("cannot parse forwarded client address")
+
+// forwarding headers a trusted proxy may maintain
+const (
+	XForwardedFor = "X-Forwarded-For"
+	Forwarded     = "Forwarded"
+)
+
+// TrustedProxies are the networks of proxies, such as a load balancer in
+// front of liberty, whose forwarding headers can be believed. Forwarding
+// headers arriving from anywhere else are ignored. Header is the one header
+// the proxies maintain, X-Forwarded-For by default or Forwarded. The other is
+// passed through untouched by most proxies, so a client could forge it, and
+// it is never believed.
+type TrustedProxies struct {
+	Nets   []*net.IPNet
+	Header string
+}
+
+// Contains reports whether ip belongs to a trusted proxy
+func (tp TrustedProxies) Contains(ip net.IP) bool {
+	for _, ipNet := range tp.Nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Forwarded reports whether the trusted proxies maintain the Forwarded header
+// rather than X-Forwarded-For
+func (tp TrustedProxies) Forwarded() bool {
+	return http.CanonicalHeaderKey(tp.Header) == Forwarded
+}
+
+// Chain returns the addresses of the client and any proxies from the header
+// the trusted proxies maintain
+func (tp TrustedProxies) Chain(h http.Header) []net.IP {
+	if tp.Forwarded() {
+		return ForwardedChain(h)
+	}
+	return ForwardedForChain(h)
+}
+
+// ClientIP returns the address of the client which made the request. The
+// chain of addresses in the header the trusted proxies maintain is walked from
+// the right and the first address which is not a trusted proxy is the client.
+// Nothing is taken from the headers unless the connecting peer is itself
+// trusted.
+func (tp TrustedProxies) ClientIP(r *http.Request) (net.IP, error) {
+	peer, err := RemoteIP(r)
+	if err != nil {
+		return nil, err
+	}
+	if !tp.Contains(peer) {
+		return peer, nil
+	}
+
+	chain := tp.Chain(r.Header)
+
+	ip := peer
+	for i := len(chain) - 1; i >= 0; i-- {
+		if chain[i] == nil {
+			return nil, errForwardedAddr
+		}
+		ip = chain[i]
+		if !tp.Contains(ip) {
+			break
+		}
+	}
+
+	return ip, nil
+}
+
+// RemoteIP is the address of the connecting peer
+func RemoteIP(r *http.Request) (net.IP, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, errForwardedAddr
+	}
+
+	return ip, nil
+}
+
+// ForwardedChain returns the addresses of the client and any proxies from the
+// Forwarded header in the order they were added. Entries which are not IP
+// addresses, such as the obfuscated identifiers allowed by RFC 7239, are
+// returned as nil.
+func ForwardedChain(h http.Header) []net.IP {
+	chain := make([]net.IP, 0)
+	for _, element := range splitList(h[Forwarded]) {
+		for _, pair := range strings.Split(element, ";") {
+			kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+			if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+				chain = append(chain, parseNode(kv[1]))
+			}
+		}
+	}
+	return chain
+}
+
+// ForwardedForChain returns the addresses of the client and any proxies from
+// the X-Forwarded-For header in the order they were added, anything which is
+// not an IP address is returned as nil
+func ForwardedForChain(h http.Header) []net.IP {
+	chain := make([]net.IP, 0)
+	for _, addr := range splitList(h[XForwardedFor]) {
+		chain = append(chain, parseNode(addr))
+	}
+	return chain
+}
+
+// split comma separated header values, which may be spread over several lines
+func splitList(values []string) []string {
+	list := make([]string, 0)
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+	return list
+}
+
+// parse a node from a Forwarded header or an address from X-Forwarded-For,
+// either may be quoted and include a port, IPv6 addresses may be bracketed
+func parseNode(node string) net.IP {
+	node = strings.Trim(node, `"`)
+
+	if strings.HasPrefix(node, "[") {
+		if end := strings.Index(node, "]"); end > 0 {
+			return net.ParseIP(node[1:end])
+		}
+		return nil
+	}
+
+	if ip := net.ParseIP(node); ip != nil {
+		return ip
+	}
+
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return net.ParseIP(host)
+	}
+
+	return nil
+}
+
+// ForwardedNode formats an IP as a node for the Forwarded header, a nil IP is
+// an unknown node
+func ForwardedNode(ip net.IP) string {
+	if ip == nil {
+		return "unknown"
+	}
+	if ip.To4() == nil {
+		return `"[` + ip.String() + `]"`
+	}
+	return ip.String()
+}
@@ -11,9 +11,9 @@ import (
 
 	"github.com/NYTimes/gziphandler"
 	"github.com/gnanderson/trie"
+	"github.com/gorilla/websocket"
 	"github.com/koding/websocketproxy"
 	"github.com/prometheus/client_golang/prometheus"
-	"golang.scot/liberty/env"
 )
 
 const (
@@ -35,14 +35,14 @@ func (hl *GzipHandler) Chain(h http.Handler) http.Handler {
 // in!
 type IPRestrictedHandler struct {
 	Allowed     []*net.IPNet
+	Trusted     TrustedProxies
 	HandlerType string
 	OpenPaths   *trie.Trie
 }
 
 func (rh *IPRestrictedHandler) Chain(h http.Handler) http.Handler {
-	appEnv := env.Get()
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ip, err := parseForwarderIP(r, appEnv)
+		ip, err := rh.Trusted.ClientIP(r)
 		if err != nil {
 			http.Error(w, err.Error(), 500)
 			return
@@ -70,33 +70,6 @@ func (rh *IPRestrictedHandler) Chain(h http.Handler) http.Handler {
 	})
 }
 
-// try to retrive the forwarding IP
-func parseForwarderIP(r *http.Request, appEnv env.Env) (ip net.IP, err error) {
-	var remote string
-	// Outside of production env we always use the remote address
-	if appEnv != env.Prod {
-		remote, _, err = net.SplitHostPort(r.RemoteAddr)
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		remote = r.Header.Get("X-Forwarded-For")
-		if remote == "" {
-			remote, _, err = net.SplitHostPort(r.RemoteAddr)
-			if err != nil {
-				return nil, err
-			}
-		}
-		// some forwarded for headers contain a sequence of IP's, in this case
-		// we are interested in the first one.
-		if strings.Contains(remote, ",") {
-			remote = strings.Split(remote, ",")[0]
-		}
-	}
-
-	return net.ParseIP(remote), nil
-}
-
 // validDomainSource checks whether the request originates at paypal
 func validDomainSource(domain string, ip net.IP) bool {
 	if names, err := net.LookupAddr(ip.String()); err == nil {
@@ -129,15 +102,20 @@ func RedirectPerm(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, url, 301)
 }
 
-func WebsocketProxy(target string, proxy http.Handler) http.Handler {
+// WebsocketProxy sends websocket upgrades to the target, connecting with the
+// TLS config given, and everything else to the proxy.
+func WebsocketProxy(target string, tlsConfig *tls.Config, proxy http.Handler) http.Handler {
 	remote, err := url.Parse(target)
 	if err != nil {
 		log.Fatal(err)
 	}
 	remote.Scheme = "wss"
 
-	websocketproxy.DefaultDialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
 	websocketProxy := websocketproxy.NewProxy(remote)
+	websocketProxy.Dialer = &websocket.Dialer{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: tlsConfig,
+	}
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
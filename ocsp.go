@@ -0,0 +1,322 @@
+package liberty
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// the most of an OCSP response that is read
+const maxOCSPResponse = 1 << 20
+
+// OCSP configures stapling of OCSP responses to the certificates liberty
+// serves, whether they come from files or ACME. Responses are kept in the
+// CacheDir, by default an "ocsp" directory in the ACME cache, and checked
+// every Interval to refresh them once they are half way to expiring. If the
+// responder can't be reached the last response keeps being stapled until it
+// expires.
+type OCSP struct {
+	Disabled bool          `yaml:"disabled"`
+	CacheDir string        `yaml:"cacheDir"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+func (o *OCSP) normalise() {
+	if o.Interval <= 0 {
+		o.Interval = time.Hour
+	}
+}
+
+// staple is the OCSP state of a certificate, a certificate without an issuer
+// or OCSP responder is tracked without a leaf so it isn't looked at again
+type staple struct {
+	mu         sync.RWMutex
+	name       string
+	leaf       *x509.Certificate
+	issuer     *x509.Certificate
+	raw        []byte
+	thisUpdate time.Time
+	nextUpdate time.Time
+}
+
+// current is the response to staple, if it hasn't expired
+func (st *staple) current(now time.Time) []byte {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	if st.raw == nil || now.After(st.nextUpdate) {
+		return nil
+	}
+	return st.raw
+}
+
+// due reports whether the response should be refreshed, half way through its
+// validity or as soon as possible if there is none
+func (st *staple) due(now time.Time) bool {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	if st.raw == nil {
+		return true
+	}
+	return now.After(st.thisUpdate.Add(st.nextUpdate.Sub(st.thisUpdate) / 2))
+}
+
+func (st *staple) set(raw []byte, resp *ocsp.Response) {
+	st.mu.Lock()
+	st.raw = raw
+	st.thisUpdate = resp.ThisUpdate
+	st.nextUpdate = resp.NextUpdate
+	st.mu.Unlock()
+
+	ocspStapleValid.WithLabelValues(st.name).Set(1)
+	ocspStapleExpiry.WithLabelValues(st.name).Set(float64(resp.NextUpdate.Unix()))
+}
+
+// expire drops a response which is out of date, the certificate is then
+// served without one
+func (st *staple) expire(now time.Time) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.raw != nil && now.After(st.nextUpdate) {
+		st.raw = nil
+		ocspStapleValid.WithLabelValues(st.name).Set(0)
+	}
+}
+
+// stapler fetches, caches and refreshes OCSP responses for leaf certificates
+type stapler struct {
+	mu       sync.RWMutex
+	dir      string
+	interval time.Duration
+	client   *http.Client
+	staples  map[string]*staple
+	done     chan struct{}
+}
+
+func newStapler(conf *OCSP) *stapler {
+	return &stapler{
+		dir:      conf.CacheDir,
+		interval: conf.Interval,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		staples:  make(map[string]*staple),
+		done:     make(chan struct{}),
+	}
+}
+
+// staple returns the certificate with its OCSP response attached if there is
+// a current one. The certificate passed in is shared, so a copy is returned.
+// A certificate seen for the first time has its response fetched in the
+// background.
+func (s *stapler) staple(cert *tls.Certificate) *tls.Certificate {
+	if s == nil || len(cert.Certificate) < 2 {
+		return cert
+	}
+
+	sum := sha256.Sum256(cert.Certificate[0])
+	key := hex.EncodeToString(sum[:])
+
+	s.mu.RLock()
+	st, ok := s.staples[key]
+	s.mu.RUnlock()
+	if !ok {
+		st = s.track(key, cert)
+	}
+
+	raw := st.current(time.Now())
+	if raw == nil {
+		return cert
+	}
+
+	stapled := *cert
+	stapled.OCSPStaple = raw
+	return &stapled
+}
+
+func (s *stapler) track(key string, cert *tls.Certificate) *staple {
+	st := &staple{}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err == nil && len(leaf.OCSPServer) > 0 {
+		if issuer, err := x509.ParseCertificate(cert.Certificate[1]); err == nil {
+			st.leaf, st.issuer = leaf, issuer
+			st.name = leaf.Subject.CommonName
+			if len(leaf.DNSNames) > 0 {
+				st.name = leaf.DNSNames[0]
+			}
+		}
+	}
+
+	s.mu.Lock()
+	if existing, ok := s.staples[key]; ok {
+		s.mu.Unlock()
+		return existing
+	}
+	s.staples[key] = st
+	s.mu.Unlock()
+
+	if st.leaf == nil {
+		return st
+	}
+
+	s.load(key, st)
+	if st.due(time.Now()) {
+		go s.refresh(key, st)
+	}
+
+	return st
+}
+
+func (s *stapler) run() {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		s.refreshAll()
+	}
+}
+
+func (s *stapler) refreshAll() {
+	now := time.Now()
+
+	s.mu.Lock()
+	due := make(map[string]*staple)
+	for key, st := range s.staples {
+		// forget certificates which have expired, such as those renewed by ACME
+		if st.leaf == nil || now.After(st.leaf.NotAfter) {
+			delete(s.staples, key)
+			continue
+		}
+		if st.due(now) {
+			due[key] = st
+		}
+	}
+	s.mu.Unlock()
+
+	for key, st := range due {
+		s.refresh(key, st)
+	}
+}
+
+// refresh fetches a new response, keeping the old one while it is still valid
+// if the responder can't be reached
+func (s *stapler) refresh(key string, st *staple) {
+	raw, resp, err := s.fetch(st.leaf, st.issuer)
+	if err != nil {
+		ocspFetchErrors.WithLabelValues(st.name).Inc()
+		log.Printf("cannot refresh the OCSP response for '%s' - %s", st.name, err)
+		st.expire(time.Now())
+		return
+	}
+
+	s.store(key, raw)
+	st.set(raw, resp)
+}
+
+func (s *stapler) fetch(leaf, issuer *x509.Certificate) ([]byte, *ocsp.Response, error) {
+	req, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	httpResp, err := s.client.Post(leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("OCSP responder returned status %d", httpResp.StatusCode)
+	}
+
+	raw, err := ioutil.ReadAll(io.LimitReader(httpResp.Body, maxOCSPResponse))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := validOCSPResponse(raw, leaf, issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return raw, resp, nil
+}
+
+// validOCSPResponse parses a response and checks it can be stapled, a revoked
+// certificate is not stapled as clients would refuse it
+func validOCSPResponse(raw []byte, leaf, issuer *x509.Certificate) (*ocsp.Response, error) {
+	resp, err := ocsp.ParseResponseForCert(raw, leaf, issuer)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Status != ocsp.Good {
+		return nil, fmt.Errorf("OCSP status is %d, not good", resp.Status)
+	}
+	if time.Now().After(resp.NextUpdate) {
+		return nil, fmt.Errorf("OCSP response expired at %s", resp.NextUpdate)
+	}
+
+	return resp, nil
+}
+
+// load a cached response from disk, if it is still valid
+func (s *stapler) load(key string, st *staple) {
+	if s.dir == "" {
+		return
+	}
+
+	raw, err := ioutil.ReadFile(filepath.Join(s.dir, key))
+	if err != nil {
+		return
+	}
+	resp, err := validOCSPResponse(raw, st.leaf, st.issuer)
+	if err != nil {
+		return
+	}
+
+	st.set(raw, resp)
+}
+
+func (s *stapler) store(key string, raw []byte) {
+	if s.dir == "" {
+		return
+	}
+
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		log.Printf("cannot cache OCSP response - %s", err)
+		return
+	}
+
+	// write then rename so a reader never sees part of a response
+	tmp := filepath.Join(s.dir, key+".tmp")
+	if err := ioutil.WriteFile(tmp, raw, 0600); err != nil {
+		log.Printf("cannot cache OCSP response - %s", err)
+		return
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, key)); err != nil {
+		log.Printf("cannot cache OCSP response - %s", err)
+	}
+}
+
+func (s *stapler) close() {
+	close(s.done)
+}
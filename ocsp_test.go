@@ -0,0 +1,196 @@
+package liberty
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// ocspFixture is a CA with an OCSP responder and a leaf certificate it issued
+type ocspFixture struct {
+	ca        *x509.Certificate
+	caKey     crypto.Signer
+	leaf      *x509.Certificate
+	cert      *tls.Certificate
+	responder *httptest.Server
+	requests  int32
+	validity  time.Duration
+}
+
+func newOCSPFixture(t *testing.T) *ocspFixture {
+	f := &ocspFixture{validity: time.Hour}
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.ca, _ = x509.ParseCertificate(caDer)
+	f.caKey = caKey
+
+	f.responder = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&f.requests, 1)
+		resp, err := ocsp.CreateResponse(f.ca, f.ca, ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: f.leaf.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(f.validity),
+		}, f.caKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(resp)
+	}))
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafTmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "www.example.com"},
+		DNSNames:     []string{"www.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		OCSPServer:   []string{f.responder.URL},
+	}
+	leafDer, err := x509.CreateCertificate(rand.Reader, leafTmpl, f.ca, &leafKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.leaf, _ = x509.ParseCertificate(leafDer)
+	f.cert = &tls.Certificate{Certificate: [][]byte{leafDer, caDer}, PrivateKey: leafKey}
+
+	return f
+}
+
+// stapleAfterFetch returns the stapled certificate once the background fetch
+// for a newly seen certificate has finished
+func stapleAfterFetch(t *testing.T, s *stapler, cert *tls.Certificate) *tls.Certificate {
+	s.staple(cert)
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if stapled := s.staple(cert); stapled.OCSPStaple != nil {
+			return stapled
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("no OCSP response was stapled")
+	return nil
+}
+
+func TestOCSPStapling(t *testing.T) {
+	f := newOCSPFixture(t)
+	defer f.responder.Close()
+
+	dir, err := ioutil.TempDir("", "liberty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := &OCSP{CacheDir: dir}
+	conf.normalise()
+	s := newStapler(conf)
+
+	stapled := stapleAfterFetch(t, s, f.cert)
+	if f.cert.OCSPStaple != nil {
+		t.Error("the shared certificate was modified")
+	}
+	if _, err := ocsp.ParseResponseForCert(stapled.OCSPStaple, f.leaf, f.ca); err != nil {
+		t.Error(err)
+	}
+
+	// a new stapler picks up the response from the disk cache, even with the
+	// responder down
+	f.responder.Close()
+	cached := newStapler(conf)
+	if cached.staple(f.cert).OCSPStaple == nil {
+		t.Error("the cached OCSP response was not stapled")
+	}
+}
+
+func TestOCSPResponderDown(t *testing.T) {
+	f := newOCSPFixture(t)
+	defer f.responder.Close()
+
+	conf := &OCSP{}
+	conf.normalise()
+	s := newStapler(conf)
+
+	stapleAfterFetch(t, s, f.cert)
+	requests := atomic.LoadInt32(&f.requests)
+
+	// a failed refresh keeps the current response
+	f.responder.Close()
+	s.mu.RLock()
+	for key, st := range s.staples {
+		s.refresh(key, st)
+	}
+	s.mu.RUnlock()
+	if s.staple(f.cert).OCSPStaple == nil {
+		t.Error("the OCSP response was dropped while still valid")
+	}
+
+	// once it expires the certificate is served without one
+	for _, st := range s.staples {
+		st.mu.Lock()
+		st.nextUpdate = time.Now().Add(-time.Second)
+		st.mu.Unlock()
+		st.expire(time.Now())
+	}
+	if s.staple(f.cert).OCSPStaple != nil {
+		t.Error("an expired OCSP response was stapled")
+	}
+	if atomic.LoadInt32(&f.requests) != requests {
+		t.Error("the closed responder was reached")
+	}
+}
+
+func TestOCSPUnstapleable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "liberty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a self signed certificate has no issuer to ask
+	crt := writeTestCert(t, dir, "self", "www.example.com")
+	cert, err := tls.LoadX509KeyPair(crt.CertFile, crt.KeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf := &OCSP{}
+	conf.normalise()
+	if newStapler(conf).staple(&cert) != &cert {
+		t.Error("expected the certificate to be served as it is")
+	}
+}
@@ -0,0 +1,144 @@
+package liberty
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OutlierDetection configures passive tracking of failed requests to each
+// member of an upstream pool. A connection error or 5xx response counts as a
+// failure, and a member is ejected from selection once it has failed
+// ConsecutiveErrors times in a row or its failure rate within the window
+// reaches ErrorRate. Each ejection lasts twice as long as the last, up to
+// MaxEjection, and the back-off decays for every window without failures.
+type OutlierDetection struct {
+	ConsecutiveErrors int           `yaml:"consecutiveErrors"`
+	ErrorRate         float64       `yaml:"errorRate"`
+	MinRequests       int           `yaml:"minRequests"`
+	Window            time.Duration `yaml:"window"`
+	BaseEjection      time.Duration `yaml:"baseEjectionTime"`
+	MaxEjection       time.Duration `yaml:"maxEjectionTime"`
+}
+
+// set defaults for anything left out of the config, an ErrorRate of zero
+// leaves only the consecutive error check enabled
+func (od *OutlierDetection) normalise() {
+	if od.ConsecutiveErrors <= 0 {
+		od.ConsecutiveErrors = 5
+	}
+	if od.MinRequests <= 0 {
+		od.MinRequests = 10
+	}
+	if od.Window <= 0 {
+		od.Window = 30 * time.Second
+	}
+	if od.BaseEjection <= 0 {
+		od.BaseEjection = 30 * time.Second
+	}
+	if od.MaxEjection < od.BaseEjection {
+		od.MaxEjection = 10 * od.BaseEjection
+	}
+}
+
+// outlierState is the passive failure tracking for a single member
+type outlierState struct {
+	mu          sync.Mutex
+	consecutive int
+	windowStart time.Time
+	requests    int
+	failures    int
+	ejections   int
+}
+
+// ejected reports whether the member is currently ejected from its pool
+func (m *member) ejected(now time.Time) bool {
+	return now.UnixNano() < atomic.LoadInt64(&m.ejectedUntil)
+}
+
+// record the result of a request against the member, returns true if this
+// result caused the member to be ejected.
+func (m *member) record(od *OutlierDetection, failed bool, now time.Time) bool {
+	o := &m.outlier
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if now.Sub(o.windowStart) >= od.Window {
+		if o.requests > 0 && o.failures == 0 && o.ejections > 0 {
+			o.ejections--
+		}
+		o.windowStart = now
+		o.requests = 0
+		o.failures = 0
+	}
+
+	o.requests++
+	if failed {
+		o.failures++
+		o.consecutive++
+	} else {
+		o.consecutive = 0
+	}
+
+	eject := o.consecutive >= od.ConsecutiveErrors ||
+		(od.ErrorRate > 0 && o.requests >= od.MinRequests &&
+			float64(o.failures)/float64(o.requests) >= od.ErrorRate)
+
+	if !eject || m.ejected(now) {
+		return false
+	}
+
+	ejection := od.BaseEjection
+	for i := 0; i < o.ejections && ejection < od.MaxEjection; i++ {
+		ejection *= 2
+	}
+	if ejection > od.MaxEjection {
+		ejection = od.MaxEjection
+	}
+	o.ejections++
+
+	// start afresh when the member returns to the pool
+	o.consecutive = 0
+	o.windowStart = now
+	o.requests = 0
+	o.failures = 0
+
+	atomic.StoreInt64(&m.ejectedUntil, now.Add(ejection).UnixNano())
+
+	return true
+}
+
+// report the result of a request to the pool's outlier detection
+func (p *pool) report(m *member, failed bool) {
+	if p.outlier == nil {
+		return
+	}
+
+	if m.record(p.outlier, failed, time.Now()) {
+		log.Printf("upstream %s for '%s' ejected after failed requests", m, p.name)
+		upstreamEjections.WithLabelValues(p.name, m.String()).Inc()
+	}
+}
+
+// retryAfter estimates when a pool with no available members might recover,
+// which is the end of the earliest ejection or the next health check.
+func (p *pool) retryAfter() time.Duration {
+	now := time.Now()
+	wait := p.recheck
+	for _, m := range p.all() {
+		if !m.ejected(now) {
+			continue
+		}
+		until := time.Duration(atomic.LoadInt64(&m.ejectedUntil) - now.UnixNano())
+		if wait == 0 || until < wait {
+			wait = until
+		}
+	}
+
+	if wait < time.Second {
+		wait = time.Second
+	}
+
+	return wait
+}
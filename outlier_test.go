@@ -0,0 +1,84 @@
+package liberty
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestConsecutiveErrorEjection(t *testing.T) {
+	od := &OutlierDetection{ConsecutiveErrors: 3, BaseEjection: time.Minute}
+	od.normalise()
+	m := &member{addr: testAddrs(1)[0]}
+	now := time.Now()
+
+	m.record(od, true, now)
+	m.record(od, true, now)
+	m.record(od, false, now)
+	m.record(od, true, now)
+	if m.ejected(now) {
+		t.Fatal("member ejected without consecutive errors")
+	}
+
+	m.record(od, true, now)
+	if !m.record(od, true, now) {
+		t.Fatal("member not ejected after consecutive errors")
+	}
+	if !m.ejected(now.Add(59*time.Second)) || m.ejected(now.Add(61*time.Second)) {
+		t.Error("first ejection should last the base ejection time")
+	}
+
+	// the second ejection backs off for twice as long
+	later := now.Add(2 * time.Minute)
+	for i := 0; i < 3; i++ {
+		m.record(od, true, later)
+	}
+	if !m.ejected(later.Add(119*time.Second)) || m.ejected(later.Add(121*time.Second)) {
+		t.Error("second ejection should last twice the base ejection time")
+	}
+}
+
+func TestErrorRateEjection(t *testing.T) {
+	od := &OutlierDetection{ConsecutiveErrors: 100, ErrorRate: 0.5, MinRequests: 4}
+	od.normalise()
+	m := &member{addr: testAddrs(1)[0]}
+	now := time.Now()
+
+	m.record(od, true, now)
+	m.record(od, false, now)
+	m.record(od, true, now)
+	if m.ejected(now) {
+		t.Fatal("member ejected before the minimum number of requests")
+	}
+	if !m.record(od, false, now) {
+		t.Fatal("member not ejected at the configured error rate")
+	}
+}
+
+func TestCircuitOpen(t *testing.T) {
+	p, err := newPool("test", RoundRobin, nil, testAddrs(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.outlier = &OutlierDetection{ConsecutiveErrors: 1, BaseEjection: 30 * time.Second}
+	p.outlier.normalise()
+
+	for _, m := range p.all() {
+		p.report(m, true)
+	}
+
+	tr := &Transport{tr: http.DefaultTransport, pool: p}
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503 with the circuit open, got %d", resp.StatusCode)
+	}
+	if ra := resp.Header.Get("Retry-After"); ra != "30" {
+		t.Errorf("expected Retry-After of 30 seconds, got '%s'", ra)
+	}
+}
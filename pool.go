@@ -0,0 +1,265 @@
+package liberty
+
+import (
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// member is a single resolved address of a remote host
+type member struct {
+	// accessed atomically, keep at the top of the struct for alignment
+	outstanding  int64
+	ejectedUntil int64
+
+	addr   *net.TCPAddr
+	weight int
+
+	// set when active health checks fail, accessed atomically
+	down uint32
+
+	// consecutive health check results, only touched by the health checker
+	successes int
+	failures  int
+
+	// passive failure tracking for outlier detection
+	outlier outlierState
+
+	// smooth weighted round robin state, guarded by the pool lock
+	current int
+}
+
+func (m *member) String() string {
+	return m.addr.String()
+}
+
+func (m *member) inFlight() int64 {
+	return atomic.LoadInt64(&m.outstanding)
+}
+
+func (m *member) healthy() bool {
+	return atomic.LoadUint32(&m.down) == 0
+}
+
+func (m *member) setHealthy(healthy bool) {
+	if healthy {
+		atomic.StoreUint32(&m.down, 0)
+	} else {
+		atomic.StoreUint32(&m.down, 1)
+	}
+}
+
+// available reports whether the member can be selected for a request
+func (m *member) available() bool {
+	return m.healthy() && !m.ejected(time.Now())
+}
+
+func (m *member) acquire() {
+	atomic.AddInt64(&m.outstanding, 1)
+}
+
+func (m *member) release() {
+	atomic.AddInt64(&m.outstanding, -1)
+}
+
+// pool is the set of addresses a reverse proxy entry balances requests over
+type pool struct {
+	mu       sync.Mutex
+	name     string
+	strategy string
+	weights  map[string]int
+	members  []*member
+	draining []*member
+	balancer balancer
+	outlier  *OutlierDetection
+	recheck  time.Duration
+	done     chan struct{}
+}
+
+// newPool creates a pool for the proxied host with a member per address, the
+// weights are keyed by IP and any address without a weight defaults to 1.
+func newPool(name string, strategy string, weights map[string]int, addrs []*net.TCPAddr) (*pool, error) {
+	b, err := newBalancer(strategy)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &pool{
+		name:     name,
+		strategy: strategy,
+		weights:  weights,
+		balancer: b,
+		members:  make([]*member, len(addrs)),
+		done:     make(chan struct{}),
+	}
+
+	for i, addr := range addrs {
+		p.members[i] = p.newMember(addr)
+	}
+
+	return p, nil
+}
+
+func (p *pool) newMember(addr *net.TCPAddr) *member {
+	weight := 1
+	if w, ok := p.weights[addr.IP.String()]; ok && w > 0 {
+		weight = w
+	}
+	return &member{addr: addr, weight: weight}
+}
+
+// update the pool to match a new set of addresses. Members for addresses
+// which remain keep their state, new addresses join the pool and members for
+// addresses which have gone are drained, taking no new requests while those
+// in flight complete.
+func (p *pool) update(addrs []*net.TCPAddr) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	current := make(map[string]*member, len(p.members))
+	for _, m := range p.members {
+		current[m.String()] = m
+	}
+
+	members := make([]*member, 0, len(addrs))
+	for _, addr := range addrs {
+		if m, ok := current[addr.String()]; ok {
+			members = append(members, m)
+			delete(current, addr.String())
+			continue
+		}
+		log.Printf("upstream %s for '%s' added", addr, p.name)
+		members = append(members, p.newMember(addr))
+	}
+
+	draining := p.draining[:0]
+	for _, m := range p.draining {
+		if m.inFlight() > 0 {
+			draining = append(draining, m)
+		}
+	}
+	for addr, m := range current {
+		log.Printf("upstream %s for '%s' removed, draining", addr, p.name)
+		upstreamUp.DeleteLabelValues(p.name, addr)
+		if m.inFlight() > 0 {
+			draining = append(draining, m)
+		}
+	}
+
+	p.members = members
+	p.draining = draining
+}
+
+// next returns the member which should receive the next request, or nil if
+// no member is available. Any members in exclude, such as those already tried
+// for a request, are passed over.
+func (p *pool) next(exclude ...*member) *member {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	available := make([]*member, 0, len(p.members))
+members:
+	for _, m := range p.members {
+		if !m.available() {
+			continue
+		}
+		for _, ex := range exclude {
+			if m == ex {
+				continue members
+			}
+		}
+		available = append(available, m)
+	}
+
+	if len(available) == 0 {
+		return nil
+	}
+
+	return p.balancer.pick(available)
+}
+
+// all returns a copy of the current members regardless of their state
+func (p *pool) all() []*member {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	members := make([]*member, len(p.members))
+	copy(members, p.members)
+
+	return members
+}
+
+// close stops any background work, such as health checks, for the pool
+func (p *pool) close() {
+	close(p.done)
+}
+
+// PoolStatus describes the state of an upstream pool for the admin endpoints
+type PoolStatus struct {
+	Name    string         `json:"name"`
+	Balance string         `json:"balance"`
+	Members []MemberStatus `json:"members"`
+}
+
+// MemberStatus describes the state of a single upstream address
+type MemberStatus struct {
+	Addr        string `json:"addr"`
+	Healthy     bool   `json:"healthy"`
+	Ejected     bool   `json:"ejected"`
+	Available   bool   `json:"available"`
+	Draining    bool   `json:"draining"`
+	Weight      int    `json:"weight"`
+	Outstanding int64  `json:"outstanding"`
+}
+
+func (p *pool) status() PoolStatus {
+	ps := PoolStatus{
+		Name:    p.name,
+		Balance: p.strategy,
+		Members: make([]MemberStatus, 0),
+	}
+
+	now := time.Now()
+	for _, m := range p.all() {
+		ps.Members = append(ps.Members, MemberStatus{
+			Addr:        m.String(),
+			Healthy:     m.healthy(),
+			Ejected:     m.ejected(now),
+			Available:   m.available(),
+			Weight:      m.weight,
+			Outstanding: m.inFlight(),
+		})
+	}
+
+	p.mu.Lock()
+	draining := make([]*member, len(p.draining))
+	copy(draining, p.draining)
+	p.mu.Unlock()
+
+	for _, m := range draining {
+		ps.Members = append(ps.Members, MemberStatus{
+			Addr:        m.String(),
+			Draining:    true,
+			Weight:      m.weight,
+			Outstanding: m.inFlight(),
+		})
+	}
+
+	return ps
+}
+
+// releaseBody keeps a request counted as outstanding against a member until
+// the proxy has finished copying the response body.
+type releaseBody struct {
+	io.ReadCloser
+	m    *member
+	once sync.Once
+}
+
+func (b *releaseBody) Close() error {
+	b.once.Do(b.m.release)
+	return b.ReadCloser.Close()
+}
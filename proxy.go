@@ -4,20 +4,33 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
 	"golang.scot/liberty/middleware"
 )
 
-// Config is a top level config struct
+// Config is a top level config struct. TrustedProxies lists the networks, in
+// CIDR format or as bare IP addresses, of any proxies in front of liberty whose
+// forwarding headers can be believed. ForwardedHeader is the header those
+// proxies maintain, either X-Forwarded-For, the default, or Forwarded. The
+// other is never believed.
 type Config struct {
-	Certs     []*Crt                     `yaml:"certs"`
-	Proxies   []*ReverseProxy            `yaml:"proxies"`
-	Whitelist []*middleware.ApiWhitelist `yaml:"whitelist"`
+	Certs           []*Crt                     `yaml:"certs"`
+	Proxies         []*ReverseProxy            `yaml:"proxies"`
+	Whitelist       []*middleware.ApiWhitelist `yaml:"whitelist"`
+	Admin           *Admin                     `yaml:"admin"`
+	TrustedProxies  []string                   `yaml:"trustedProxies, flow"`
+	ForwardedHeader string                     `yaml:"forwardedHeader"`
+	Listeners       []*ListenerConfig          `yaml:"listeners"`
+	ACME            *ACME                      `yaml:"acme"`
+	OCSP            *OCSP                      `yaml:"ocsp"`
 }
 
 // Proxy is a reverse HTTP proxy
@@ -26,6 +39,8 @@ type Proxy struct {
 	group    *ServerGroup
 	secure   map[string]*VHost
 	insecure map[string]*VHost
+	certs    *certSelector
+	tlsAddrs map[string]bool
 }
 
 // NewProxy returns a Proxy configured for use
@@ -34,11 +49,24 @@ func NewProxy(config *Config) *Proxy {
 		config:   config,
 		secure:   map[string]*VHost{},
 		insecure: map[string]*VHost{},
+		tlsAddrs: map[string]bool{},
 	}
 
+	if p.config.ACME == nil {
+		p.config.ACME = &ACME{}
+	}
+	p.config.ACME.normalise()
+	challenges := newChallengePolicy(p.config.ACME.Challenges)
+	clientAuth := make(map[string]bool)
+
 	servers := make([]*http.Server, 0)
+	trusted, err := config.trustedProxies()
+	if err != nil {
+		log.Fatalf("cannot configure the trusted proxies - %s", err)
+	}
 
 	for _, proxy := range p.config.Proxies {
+		proxy.trusted = trusted
 		host, _ := proxy.hostAndPath()
 
 		if _, ok := p.secure[host]; !ok {
@@ -72,14 +100,124 @@ func NewProxy(config *Config) *Proxy {
 			continue
 		}
 
+		hosts := append([]string{host}, proxy.HostAlias...)
+		challenges.add(hosts, proxy.Challenges)
+		if proxy.ClientAuth != nil {
+			for _, h := range hosts {
+				clientAuth[strings.ToLower(h)] = true
+			}
+		}
 		servers = append(servers, proxy.Servers...)
+		for addr, secure := range proxy.listeners {
+			p.tlsAddrs[addr] = secure
+		}
+	}
+
+	added, err := p.listen()
+	if err != nil {
+		log.Fatalf("cannot configure the listeners - %s", err)
 	}
+	servers = append(servers, added...)
 
 	p.group = NewServerGroup(p, servers)
 
+	m, err := newAcmeManager(p.config.ACME, p.vhostDomains(), challenges)
+	if err != nil {
+		log.Fatalf("cannot configure ACME - %s", err)
+	}
+	p.certs = &certSelector{
+		static:     newCertStore(config.Certs),
+		acme:       m,
+		challenges: challenges,
+		clientAuth: clientAuth,
+	}
+
+	if p.config.OCSP == nil {
+		p.config.OCSP = &OCSP{}
+	}
+	p.config.OCSP.normalise()
+	if p.config.OCSP.CacheDir == "" && p.config.ACME.CacheDir != "" {
+		p.config.OCSP.CacheDir = filepath.Join(p.config.ACME.CacheDir, "ocsp")
+	}
+	if !p.config.OCSP.Disabled {
+		p.certs.ocsp = newStapler(p.config.OCSP)
+	}
+
+	// the plain HTTP servers only answer challenges and redirect to https
+	insecure := challenges.httpHandler(m)
+	for _, s := range p.group.servers {
+		if !s.secure {
+			s.handler = insecure
+			s.s.Handler = insecure
+		}
+	}
+
+	for _, lc := range p.config.Listeners {
+		if lc.ProxyProtocol == nil {
+			continue
+		}
+		pp, err := newProxyProtocol(lc.ProxyProtocol)
+		if err != nil {
+			log.Fatalf("cannot configure the PROXY protocol for '%s' - %s", lc.Addr, err)
+		}
+		for _, s := range p.group.servers {
+			if s.s.Addr == lc.Addr {
+				s.proxyProto = pp
+			}
+		}
+	}
+
 	return p
 }
 
+// listen applies the listener configs choosing whether an address serves TLS,
+// returning servers for any addresses no proxy entry is served on
+func (p *Proxy) listen() ([]*http.Server, error) {
+	added := make([]*http.Server, 0)
+	for _, lc := range p.config.Listeners {
+		_, known := p.tlsAddrs[lc.Addr]
+		if !known && lc.TLS == nil {
+			return nil, fmt.Errorf("listener '%s' isn't used by a proxy entry and needs tls set", lc.Addr)
+		}
+		if lc.TLS != nil {
+			p.tlsAddrs[lc.Addr] = *lc.TLS
+		}
+		if !known {
+			added = append(added, &http.Server{Addr: lc.Addr})
+		}
+	}
+
+	return added, nil
+}
+
+// serveTLS reports whether the server for the address serves TLS, which it
+// does unless it has been configured otherwise
+func (p *Proxy) serveTLS(addr string) bool {
+	secure, ok := p.tlsAddrs[addr]
+	return secure || !ok
+}
+
+func (c *Config) trustedProxies() (middleware.TrustedProxies, error) {
+	nets, err := middleware.ParseNets(c.TrustedProxies)
+	if err != nil {
+		return middleware.TrustedProxies{}, err
+	}
+
+	tp := middleware.TrustedProxies{
+		Nets:   nets,
+		Header: http.CanonicalHeaderKey(c.ForwardedHeader),
+	}
+	switch tp.Header {
+	case "":
+		tp.Header = middleware.XForwardedFor
+	case middleware.XForwardedFor, middleware.Forwarded:
+	default:
+		return tp, fmt.Errorf("unknown forwarded header '%s'", c.ForwardedHeader)
+	}
+
+	return tp, nil
+}
+
 func (p *Proxy) vhostDomains() []string {
 	domains := make([]string, 0)
 	for host := range p.secure {
@@ -97,10 +235,13 @@ const gracePriod = 5 // seconds
 func (p *Proxy) Serve() {
 	startServer := func(s *server) {
 		fmt.Println("server lisening: ", s.s.Addr)
-		domains := make([]string, 0)
-		domains = append(domains, p.vhostDomains()...)
-		fmt.Println("server domains: ", domains)
-		log.Println(s.s.Serve(s.Listener(domains)))
+		fmt.Println("server domains: ", p.vhostDomains())
+		log.Println(s.s.Serve(s.Listener(p.certs)))
+	}
+
+	go p.certs.static.run()
+	if p.certs.ocsp != nil {
+		go p.certs.ocsp.run()
 	}
 
 	var wg sync.WaitGroup
@@ -110,6 +251,18 @@ func (p *Proxy) Serve() {
 		go startServer(s)
 	}
 
+	admin, err := p.adminServer()
+	if err != nil {
+		log.Printf("the admin listener was not started - %s", err)
+	}
+	if admin != nil {
+		wg.Add(1)
+		go func() {
+			fmt.Println("admin lisening: ", admin.Addr)
+			log.Println(p.config.Admin.serve(admin))
+		}()
+	}
+
 	sig := make(chan os.Signal)
 	signal.Notify(sig, os.Interrupt, os.Kill)
 	<-sig
@@ -123,13 +276,35 @@ func (p *Proxy) Serve() {
 			wg.Done()
 		}(s.s)
 	}
+	if admin != nil {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), gracePriod*time.Second)
+			defer cancel()
+			admin.Shutdown(ctx)
+			wg.Done()
+		}()
+	}
 
 	wg.Wait()
+
+	p.certs.static.close()
+	if p.certs.ocsp != nil {
+		p.certs.ocsp.close()
+	}
+	for _, proxy := range p.config.Proxies {
+		if proxy.pool != nil {
+			proxy.pool.close()
+		}
+	}
 	log.Println("Done, exiting")
 }
 
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if vhost, ok := p.secure[r.Host]; ok {
+		if p.misdirected(r) {
+			http.Error(w, http.StatusText(http.StatusMisdirectedRequest), http.StatusMisdirectedRequest)
+			return
+		}
 		fmt.Println(vhost, r.URL.String())
 		vhost.handler.ServeHTTP(w, r)
 		return
@@ -137,3 +312,19 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	http.NotFound(w, r)
 }
+
+// misdirected reports whether a request for a host asking for client
+// certificates came on a connection made for a host which doesn't, as HTTP/2
+// connections are reused for hosts sharing a certificate. A 421 has the client
+// retry on a connection of its own, where it is asked for its certificate.
+func (p *Proxy) misdirected(r *http.Request) bool {
+	if r.TLS == nil || r.TLS.ServerName == "" || p.certs == nil {
+		return false
+	}
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return p.certs.clientCerts(host) && !p.certs.clientCerts(r.TLS.ServerName)
+}
@@ -0,0 +1,329 @@
+package liberty
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.scot/liberty/middleware"
+)
+
+// ProxyProtocol configures a listener to accept HAProxy PROXY protocol v1 and
+// v2 headers, as sent by TCP load balancers to pass on the client address.
+// Only connections from the Trusted networks, in CIDR format or as bare IP
+// addresses, must send the header and any others are served as they are.
+// Timeout bounds the wait for the header.
+type ProxyProtocol struct {
+	Trusted []string      `yaml:"trusted, flow"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+var (
+	errProxyHeader = errors.New("invalid PROXY protocol header")
+
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+const (
+	proxyV1MaxLen = 107
+	proxyV2Local  = 0x20
+	proxyV2Proxy  = 0x21
+	proxyV2TCP4   = 0x11
+	proxyV2TCP6   = 0x21
+)
+
+// proxyProtocol is the runtime form of ProxyProtocol for a listener
+type proxyProtocol struct {
+	trusted middleware.TrustedProxies
+	timeout time.Duration
+}
+
+func newProxyProtocol(conf *ProxyProtocol) (*proxyProtocol, error) {
+	nets, err := middleware.ParseNets(conf.Trusted)
+	if err != nil {
+		return nil, err
+	}
+
+	pp := &proxyProtocol{
+		trusted: middleware.TrustedProxies{Nets: nets},
+		timeout: conf.Timeout,
+	}
+	if pp.timeout <= 0 {
+		pp.timeout = 5 * time.Second
+	}
+	return pp, nil
+}
+
+// wrap the connection if it comes from a trusted source
+func (pp *proxyProtocol) wrap(conn net.Conn) net.Conn {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok || !pp.trusted.Contains(addr.IP) {
+		return conn
+	}
+
+	return &proxyConn{
+		Conn:    conn,
+		r:       bufio.NewReader(conn),
+		timeout: pp.timeout,
+	}
+}
+
+// proxyConn reads the PROXY protocol header the first time the connection is
+// used, rather than when accepted, so that a slow client doesn't hold up the
+// accept loop. The addresses from the header replace those of the connection.
+type proxyConn struct {
+	net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+
+	once   sync.Once
+	err    error
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		c.remote, c.local, c.err = readProxyHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	c.init()
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+// readProxyHeader reads a v1 or v2 header, the addresses are nil for a header
+// which doesn't carry any, such as v1 UNKNOWN or a v2 LOCAL command.
+func readProxyHeader(r *bufio.Reader) (remote, local net.Addr, err error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if bytes.Equal(sig, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return readProxyV1(r)
+	}
+
+	return nil, nil, errProxyHeader
+}
+
+func readProxyV1(r *bufio.Reader) (remote, local net.Addr, err error) {
+	line := make([]byte, 0, proxyV1MaxLen)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) == proxyV1MaxLen {
+			return nil, nil, errProxyHeader
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errProxyHeader
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, errProxyHeader
+	}
+
+	src, err := parseProxyV1Addr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parseProxyV1Addr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return src, dst, nil
+}
+
+func parseProxyV1Addr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	p, err := strconv.ParseUint(port, 10, 16)
+	if ip == nil || err != nil {
+		return nil, errProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+func readProxyV2(r *bufio.Reader) (remote, local net.Addr, err error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+
+	cmd := header[12]
+	family := header[13]
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+
+	switch cmd {
+	case proxyV2Local:
+		return nil, nil, nil
+	case proxyV2Proxy:
+	default:
+		return nil, nil, errProxyHeader
+	}
+
+	var size int
+	switch family {
+	case proxyV2TCP4:
+		size = net.IPv4len
+	case proxyV2TCP6:
+		size = net.IPv6len
+	default:
+		// not a TCP connection, the addresses aren't any use to us
+		return nil, nil, nil
+	}
+
+	if len(body) < size*2+4 {
+		return nil, nil, errProxyHeader
+	}
+
+	src := &net.TCPAddr{
+		IP:   net.IP(body[:size]),
+		Port: int(binary.BigEndian.Uint16(body[size*2:])),
+	}
+	dst := &net.TCPAddr{
+		IP:   net.IP(body[size : size*2]),
+		Port: int(binary.BigEndian.Uint16(body[size*2+2:])),
+	}
+
+	return src, dst, nil
+}
+
+type clientAddrKey struct{}
+
+// withClientAddr records the client address for the upstream dialer, which
+// only sees the context of the request
+func withClientAddr(ctx context.Context, addr string) context.Context {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, clientAddrKey{}, tcpAddr)
+}
+
+// proxyProtocolDialer writes a PROXY protocol header at the start of each new
+// upstream connection, carrying the address of the client and the address it
+// connected to liberty on. Connections must not be shared between clients, so
+// keep alives have to be disabled on the transport using it.
+func proxyProtocolDialer(version int, dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		src, _ := ctx.Value(clientAddrKey{}).(*net.TCPAddr)
+		dst, _ := ctx.Value(http.LocalAddrContextKey).(*net.TCPAddr)
+		if err := writeProxyHeader(conn, version, src, dst); err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		return conn, nil
+	}
+}
+
+// writeProxyHeader writes a v1 or v2 header, falling back to v1 UNKNOWN or a
+// v2 LOCAL command if either address is missing.
+func writeProxyHeader(w io.Writer, version int, src, dst *net.TCPAddr) error {
+	if version == 1 {
+		_, err := io.WriteString(w, proxyV1Header(src, dst))
+		return err
+	}
+
+	_, err := w.Write(proxyV2HeaderBytes(src, dst))
+	return err
+}
+
+func proxyV1Header(src, dst *net.TCPAddr) string {
+	if src == nil || dst == nil {
+		return "PROXY UNKNOWN\r\n"
+	}
+
+	family := "TCP4"
+	srcIP, dstIP := src.IP.To4(), dst.IP.To4()
+	if srcIP == nil || dstIP == nil {
+		// v1 can't mix families, so send both as IPv6
+		family = "TCP6"
+		srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+	}
+
+	return fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, srcIP, dstIP, src.Port, dst.Port)
+}
+
+func proxyV2HeaderBytes(src, dst *net.TCPAddr) []byte {
+	var buf bytes.Buffer
+	buf.Write(proxyV2Signature)
+
+	if src == nil || dst == nil {
+		buf.Write([]byte{proxyV2Local, 0, 0, 0})
+		return buf.Bytes()
+	}
+
+	family := byte(proxyV2TCP4)
+	srcIP, dstIP := []byte(src.IP.To4()), []byte(dst.IP.To4())
+	if srcIP == nil || dstIP == nil {
+		family = proxyV2TCP6
+		srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+	}
+
+	buf.WriteByte(proxyV2Proxy)
+	buf.WriteByte(family)
+	binary.Write(&buf, binary.BigEndian, uint16(len(srcIP)*2+4))
+	buf.Write(srcIP)
+	buf.Write(dstIP)
+	binary.Write(&buf, binary.BigEndian, uint16(src.Port))
+	binary.Write(&buf, binary.BigEndian, uint16(dst.Port))
+
+	return buf.Bytes()
+}
@@ -0,0 +1,238 @@
+package liberty
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func proxyV2Header(cmd, family byte, addrs []byte) []byte {
+	var buf bytes.Buffer
+	buf.Write(proxyV2Signature)
+	buf.WriteByte(cmd)
+	buf.WriteByte(family)
+	binary.Write(&buf, binary.BigEndian, uint16(len(addrs)))
+	buf.Write(addrs)
+	return buf.Bytes()
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0x30, 0x39, 0x01, 0xbb}
+	v6 := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0x30, 0x39, 0x01, 0xbb)
+
+	tests := []struct {
+		header string
+		remote string
+		local  string
+		fails  bool
+	}{
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 12345 443\r\n", "192.0.2.1:12345", "198.51.100.1:443", false},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 12345 443\r\n", "[2001:db8::1]:12345", "[2001:db8::2]:443", false},
+		{"PROXY UNKNOWN\r\n", "", "", false},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 12345\r\n", "", "", true},
+		{"PROXY TCP4 not.an.ip 198.51.100.1 12345 443\r\n", "", "", true},
+		{"GET / HTTP/1.1\r\n\r\n", "", "", true},
+		{string(proxyV2Header(proxyV2Proxy, proxyV2TCP4, v4)), "192.0.2.1:12345", "198.51.100.1:443", false},
+		{string(proxyV2Header(proxyV2Proxy, proxyV2TCP6, v6)), "[2001:db8::1]:12345", "[2001:db8::2]:443", false},
+		{string(proxyV2Header(proxyV2Local, 0, nil)), "", "", false},
+		{string(proxyV2Header(proxyV2Proxy, proxyV2TCP4, v4[:6])), "", "", true},
+	}
+
+	for i, test := range tests {
+		r := bufio.NewReader(strings.NewReader(test.header + "payload"))
+		remote, local, err := readProxyHeader(r)
+		if test.fails {
+			if err == nil {
+				t.Errorf("header %d - expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("header %d - %s", i, err)
+			continue
+		}
+
+		if test.remote == "" {
+			if remote != nil || local != nil {
+				t.Errorf("header %d - expected no addresses, got %s, %s", i, remote, local)
+			}
+		} else if remote.String() != test.remote || local.String() != test.local {
+			t.Errorf("header %d - expected %s, %s, got %s, %s", i, test.remote, test.local, remote, local)
+		}
+
+		if rest, _ := ioutil.ReadAll(r); string(rest) != "payload" {
+			t.Errorf("header %d - data after the header was lost, got '%s'", i, rest)
+		}
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	pp, err := newProxyProtocol(&ProxyProtocol{Trusted: []string{"127.0.0.0/8"}, Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 12345 443\r\nhello"))
+	}()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn = pp.wrap(conn)
+	defer conn.Close()
+
+	if addr := conn.RemoteAddr().String(); addr != "192.0.2.1:12345" {
+		t.Errorf("expected the client address from the header, got %s", addr)
+	}
+
+	buf := make([]byte, 5)
+	if _, err := conn.Read(buf); err != nil || string(buf) != "hello" {
+		t.Errorf("expected to read the data after the header, got '%s' - %v", buf, err)
+	}
+}
+
+func TestProxyProtocolUntrusted(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	pp, err := newProxyProtocol(&ProxyProtocol{Trusted: []string{"10.0.0.0/8"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pp.wrap(server) != server {
+		t.Error("connection from an untrusted source should not be wrapped")
+	}
+}
+
+func TestProxyProtocolTrusted(t *testing.T) {
+	pp, err := newProxyProtocol(&ProxyProtocol{Trusted: []string{"10.0.0.1", "2001:db8::/32"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pp.trusted.Contains(net.ParseIP("10.0.0.1")) || pp.trusted.Contains(net.ParseIP("10.0.0.2")) {
+		t.Error("a bare IP should trust that address alone")
+	}
+
+	if _, err := newProxyProtocol(&ProxyProtocol{Trusted: []string{"10.0.0"}}); err == nil {
+		t.Error("expected an error for a bad trusted network")
+	}
+}
+
+func TestWriteProxyHeader(t *testing.T) {
+	v4 := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 12345}
+	v6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}
+	local := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443}
+
+	tests := []struct {
+		src, dst *net.TCPAddr
+		remote   string
+		local    string
+	}{
+		{v4, local, "192.0.2.1:12345", "198.51.100.1:443"},
+		{v4, v6, "192.0.2.1:12345", "[2001:db8::2]:443"},
+		{nil, local, "", ""},
+	}
+
+	for _, version := range []int{1, 2} {
+		for i, test := range tests {
+			var buf bytes.Buffer
+			if err := writeProxyHeader(&buf, version, test.src, test.dst); err != nil {
+				t.Fatal(err)
+			}
+
+			remote, local, err := readProxyHeader(bufio.NewReader(&buf))
+			if err != nil {
+				t.Errorf("v%d header %d - %s", version, i, err)
+				continue
+			}
+			if test.remote == "" {
+				if remote != nil || local != nil {
+					t.Errorf("v%d header %d - expected no addresses, got %s %s", version, i, remote, local)
+				}
+				continue
+			}
+			if !sameAddr(remote, test.remote) || !sameAddr(local, test.local) {
+				t.Errorf("v%d header %d - expected %s %s, got %s %s", version, i, test.remote, test.local, remote, local)
+			}
+		}
+	}
+}
+
+// compare addresses allowing for IPv4 being sent as IPv4 mapped IPv6
+func sameAddr(addr net.Addr, want string) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	expected, err := net.ResolveTCPAddr("tcp", want)
+	return ok && err == nil && tcpAddr.IP.Equal(expected.IP) && tcpAddr.Port == expected.Port
+}
+
+type proxyProtoListener struct {
+	net.Listener
+	pp *proxyProtocol
+}
+
+func (ln proxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return ln.pp.wrap(conn), nil
+}
+
+func TestProxyProtocolUpstream(t *testing.T) {
+	for _, version := range []int{1, 2} {
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.RemoteAddr))
+		}))
+		pp, err := newProxyProtocol(&ProxyProtocol{Trusted: []string{"127.0.0.1"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv.Listener = proxyProtoListener{srv.Listener, pp}
+		srv.Start()
+
+		u := &Upstream{ProxyProtocol: version}
+		u.normalise()
+		tr := testTransport(t, &Transport{tr: u.transport(nil), clientAddr: true}, srv.Listener.Addr().(*net.TCPAddr))
+
+		for _, client := range []string{"192.0.2.1:1234", "192.0.2.2:5678"} {
+			r := httptest.NewRequest("GET", "http://example.com/", nil)
+			r.RemoteAddr = client
+			local := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443}
+			r = r.WithContext(context.WithValue(r.Context(), http.LocalAddrContextKey, local))
+
+			resp, err := tr.RoundTrip(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != client {
+				t.Errorf("v%d - expected upstream to see client %s, got %s", version, client, body)
+			}
+		}
+
+		srv.Close()
+	}
+}
@@ -0,0 +1,314 @@
+package liberty
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.scot/liberty/middleware"
+)
+
+// what rate limits are counted against
+const (
+	RateLimitIP     = "ip"
+	RateLimitHeader = "header"
+	RateLimitUser   = "user"
+)
+
+// RateLimit limits the requests to a proxy entry, or to Path and the paths
+// below it, to Requests every Period for each client, with bursts of up to
+// Burst requests. Clients are told apart by their IP address, taken from the
+// forwarding headers of trusted proxies, by the value of Header or by their
+// basic auth user name, depending on the Key. A client without the header is
+// limited by its IP address. A user limit takes a token for the IP address
+// before the credentials are checked, so guessing passwords is held to it,
+// and then one for the user if they verify. Only the LIBERTY_USER credentials
+// verify, so every authenticated client shares the user's bucket.
+//
+// Only the MaxKeys most recently seen clients are remembered, a client which
+// is forgotten starts again with a full allowance.
+type RateLimit struct {
+	Path     string        `yaml:"path"`
+	Requests int           `yaml:"requests"`
+	Period   time.Duration `yaml:"period"`
+	Burst    int           `yaml:"burst"`
+	Key      string        `yaml:"key"`
+	Header   string        `yaml:"header"`
+	MaxKeys  int           `yaml:"maxKeys"`
+}
+
+func (rl *RateLimit) normalise() {
+	if rl.Period <= 0 {
+		rl.Period = time.Second
+	}
+	if rl.Burst <= 0 {
+		rl.Burst = rl.Requests
+	}
+	if rl.Key == "" {
+		rl.Key = RateLimitIP
+	}
+	if rl.MaxKeys <= 0 {
+		rl.MaxKeys = 10000
+	}
+}
+
+func (rl *RateLimit) validate() error {
+	if rl.Requests <= 0 {
+		return fmt.Errorf("rate limit for '%s' needs a number of requests", rl.Path)
+	}
+	switch rl.Key {
+	case RateLimitIP, RateLimitUser:
+	case RateLimitHeader:
+		if rl.Header == "" {
+			return fmt.Errorf("rate limit for '%s' is keyed by a header but has none", rl.Path)
+		}
+	default:
+		return fmt.Errorf("unknown rate limit key '%s'", rl.Key)
+	}
+	return nil
+}
+
+// bucket holds the tokens of one client, a request takes a token
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+	elem   *list.Element
+}
+
+// limiter is the token buckets for one rate limit, the least recently used
+// are dropped to keep within MaxKeys
+type limiter struct {
+	conf    *RateLimit
+	rate    float64
+	burst   float64
+	trusted middleware.TrustedProxies
+	now     func() time.Time
+
+	mu      sync.Mutex
+	lru     *list.List
+	buckets map[string]*bucket
+}
+
+func newLimiter(conf *RateLimit, trusted middleware.TrustedProxies) (*limiter, error) {
+	conf.normalise()
+	if err := conf.validate(); err != nil {
+		return nil, err
+	}
+
+	return &limiter{
+		conf:    conf,
+		rate:    float64(conf.Requests) / conf.Period.Seconds(),
+		burst:   float64(conf.Burst),
+		trusted: trusted,
+		now:     time.Now,
+		lru:     list.New(),
+		buckets: make(map[string]*bucket),
+	}, nil
+}
+
+// matches reports whether the path is the limit's path or below it, so that a
+// limit on /api doesn't cover /apiary
+func (l *limiter) matches(path string) bool {
+	prefix := strings.TrimSuffix(l.conf.Path, "/")
+	return prefix == "" || path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// key tells clients apart, falling back to the IP address. User limits are
+// keyed by the IP address until the credentials are verified.
+func (l *limiter) key(r *http.Request) string {
+	if l.conf.Key == RateLimitHeader {
+		if v := r.Header.Get(l.conf.Header); v != "" {
+			return "header:" + v
+		}
+	}
+
+	if ip, err := l.trusted.ClientIP(r); err == nil {
+		return "ip:" + ip.String()
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// limitState is the outcome of taking a token, for the response headers
+type limitState struct {
+	allowed   bool
+	remaining int
+	reset     time.Duration
+	wait      time.Duration
+}
+
+// refill finds the client's bucket and tops it up for the time since it was
+// last used, l.mu must be held
+func (l *limiter) refill(key string) *bucket {
+	now := l.now()
+	b, ok := l.buckets[key]
+	if ok {
+		b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+		b.last = now
+		l.lru.MoveToFront(b.elem)
+	} else {
+		b = &bucket{key: key, tokens: l.burst, last: now}
+		b.elem = l.lru.PushFront(b)
+		l.buckets[key] = b
+		for len(l.buckets) > l.conf.MaxKeys {
+			oldest := l.lru.Back().Value.(*bucket)
+			l.lru.Remove(oldest.elem)
+			delete(l.buckets, oldest.key)
+		}
+	}
+
+	return b
+}
+
+// check whether the bucket has a token, without taking it
+func (l *limiter) check(b *bucket) limitState {
+	st := limitState{
+		allowed:   b.tokens >= 1,
+		remaining: int(b.tokens),
+		reset:     l.duration(l.burst - b.tokens),
+	}
+	if !st.allowed {
+		st.wait = l.duration(1 - b.tokens)
+	}
+	return st
+}
+
+// consume a token from a bucket which has one
+func (l *limiter) consume(b *bucket) limitState {
+	b.tokens--
+	st := l.check(b)
+	st.allowed, st.wait = true, 0
+	return st
+}
+
+// duration is how long it takes for tokens to be added
+func (l *limiter) duration(tokens float64) time.Duration {
+	return time.Duration(tokens / l.rate * float64(time.Second))
+}
+
+// rateLimits applies the rate limits of a proxy entry, every limit whose path
+// matches a request must allow it
+type rateLimits struct {
+	name     string
+	limiters []*limiter
+	verify   func(*http.Request) (*http.Request, string, bool)
+}
+
+func newRateLimits(name string, confs []*RateLimit, trusted middleware.TrustedProxies) (*rateLimits, error) {
+	rls := &rateLimits{name: name, verify: middleware.EnvBasicAuth().Verify}
+	for _, conf := range confs {
+		l, err := newLimiter(conf, trusted)
+		if err != nil {
+			return nil, err
+		}
+		rls.limiters = append(rls.limiters, l)
+	}
+	return rls, nil
+}
+
+func (rls *rateLimits) Chain(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, l, st := rls.take(r)
+		if l != nil && !st.allowed {
+			rateLimited.WithLabelValues(rls.name, l.conf.Path).Inc()
+			setRateLimitHeaders(w.Header(), l, st)
+			w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(st.wait)))
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+
+		if l != nil {
+			setRateLimitHeaders(w.Header(), l, st)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// take a token from every limit matching the request, or from none if one of
+// them refuses it. The refusing limit is returned, otherwise the one with the
+// fewest tokens left, or nil if none match. Credentials are only verified for
+// user limits once the IP address tokens are taken, and the request is
+// returned with the verified user for the basic auth handler.
+func (rls *rateLimits) take(r *http.Request) (*http.Request, *limiter, limitState) {
+	var matched, users []*limiter
+	var keys []string
+	for _, l := range rls.limiters {
+		if l.matches(r.URL.Path) {
+			matched = append(matched, l)
+			keys = append(keys, l.key(r))
+			if l.conf.Key == RateLimitUser {
+				users = append(users, l)
+			}
+		}
+	}
+
+	l, st := takeAll(matched, keys)
+	if len(users) == 0 || !st.allowed {
+		return r, l, st
+	}
+
+	r, user, ok := rls.verify(r)
+	if !ok || user == "" {
+		return r, l, st
+	}
+	keys = keys[:0]
+	for range users {
+		keys = append(keys, "user:"+user)
+	}
+	if ul, ust := takeAll(users, keys); !ust.allowed || ust.remaining < st.remaining {
+		l, st = ul, ust
+	}
+	return r, l, st
+}
+
+// takeAll takes a token from each of the limits for its key, or from none if
+// one of them refuses
+func takeAll(matched []*limiter, keys []string) (*limiter, limitState) {
+	// the limits are always locked in the same order
+	for _, l := range matched {
+		l.mu.Lock()
+	}
+	defer func() {
+		for _, l := range matched {
+			l.mu.Unlock()
+		}
+	}()
+
+	buckets := make([]*bucket, len(matched))
+	for i, l := range matched {
+		buckets[i] = l.refill(keys[i])
+		if st := l.check(buckets[i]); !st.allowed {
+			return l, st
+		}
+	}
+
+	var tightest *limiter
+	var state limitState
+	for i, l := range matched {
+		st := l.consume(buckets[i])
+		if tightest == nil || st.remaining < state.remaining {
+			tightest, state = l, st
+		}
+	}
+	return tightest, state
+}
+
+func setRateLimitHeaders(h http.Header, l *limiter, st limitState) {
+	h.Set("RateLimit-Limit", strconv.Itoa(l.conf.Burst))
+	h.Set("RateLimit-Remaining", strconv.Itoa(st.remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(st.reset)))
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
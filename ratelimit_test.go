@@ -0,0 +1,193 @@
+package liberty
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.scot/liberty/middleware"
+)
+
+// takeFrom takes a token through the limits for a request from the address
+func takeFrom(rls *rateLimits, addr string) limitState {
+	r := httptest.NewRequest("GET", "http://example.com/", nil)
+	r.RemoteAddr = addr + ":1234"
+	_, _, st := rls.take(r)
+	return st
+}
+
+func TestRateLimitBucket(t *testing.T) {
+	rls, err := newRateLimits("test", []*RateLimit{{Requests: 2, Period: time.Second}}, middleware.TrustedProxies{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &testClock{now: time.Now()}
+	rls.limiters[0].now = clock.Now
+
+	for i := 0; i < 2; i++ {
+		if st := takeFrom(rls, "192.0.2.1"); !st.allowed || st.remaining != 1-i {
+			t.Fatalf("request %d within the burst was refused or miscounted - %+v", i, st)
+		}
+	}
+	st := takeFrom(rls, "192.0.2.1")
+	if st.allowed || st.wait != 500*time.Millisecond {
+		t.Errorf("expected a wait of 500ms once the bucket is empty, got %+v", st)
+	}
+	if !takeFrom(rls, "192.0.2.2").allowed {
+		t.Errorf("another client shares the bucket")
+	}
+
+	clock.advance(500 * time.Millisecond)
+	if st = takeFrom(rls, "192.0.2.1"); !st.allowed || st.remaining != 0 || st.reset != time.Second {
+		t.Errorf("bucket was not topped up - %+v", st)
+	}
+}
+
+func TestRateLimitMaxKeys(t *testing.T) {
+	rls, _ := newRateLimits("test", []*RateLimit{{Requests: 1, Period: time.Minute, MaxKeys: 2}}, middleware.TrustedProxies{})
+	takeFrom(rls, "192.0.2.1")
+	takeFrom(rls, "192.0.2.2")
+	takeFrom(rls, "192.0.2.1")
+	takeFrom(rls, "192.0.2.3")
+
+	l := rls.limiters[0]
+	if len(l.buckets) != 2 || l.lru.Len() != 2 {
+		t.Fatalf("expected 2 clients tracked, got %d", len(l.buckets))
+	}
+	if _, ok := l.buckets["ip:192.0.2.2"]; ok {
+		t.Errorf("least recently seen client was kept")
+	}
+	// a forgotten client starts with a full bucket
+	if !takeFrom(rls, "192.0.2.2").allowed {
+		t.Errorf("forgotten client was refused")
+	}
+}
+
+func TestRateLimitHandler(t *testing.T) {
+	trusted := middleware.TrustedProxies{Nets: middleware.IPs2nets([]string{"10.0.0.0/8"})}
+	rls, err := newRateLimits("test", []*RateLimit{
+		{Requests: 100, Period: time.Minute},
+		{Path: "/api/", Requests: 1, Period: time.Minute},
+		{Path: "/keyed/", Requests: 1, Period: time.Minute, Key: RateLimitHeader, Header: "X-Api-Key"},
+		{Path: "/users/", Requests: 1, Period: time.Minute, Key: RateLimitUser},
+	}, trusted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verified := 0
+	auth := middleware.NewBasicAuth("alice", "secret")
+	rls.verify = func(r *http.Request) (*http.Request, string, bool) {
+		verified++
+		return auth.Verify(r)
+	}
+	h := rls.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	do := func(path, remote string, header ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "http://example.com"+path, nil)
+		r.RemoteAddr = remote
+		for i := 0; i+1 < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w := do("/api/a", "192.0.2.1:1234")
+	if w.Code != http.StatusOK || w.Header().Get("RateLimit-Remaining") != "0" || w.Header().Get("RateLimit-Limit") != "1" {
+		t.Fatalf("first request refused or headers not from the tightest limit - %d %v", w.Code, w.Header())
+	}
+	w = do("/api/b", "192.0.2.1:1234")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "60" || w.Header().Get("RateLimit-Reset") != "60" {
+		t.Errorf("expected 429 with Retry-After 60, got %d %v", w.Code, w.Header())
+	}
+	// the refused request took nothing from the limit for every path
+	if w = do("/other", "192.0.2.1:1234"); w.Code != http.StatusOK || w.Header().Get("RateLimit-Limit") != "100" || w.Header().Get("RateLimit-Remaining") != "98" {
+		t.Errorf("path outside the limit was refused or charged for the refused request - %d %v", w.Code, w.Header())
+	}
+	if w = do("/apiary", "192.0.2.1:1234"); w.Code != http.StatusOK || w.Header().Get("RateLimit-Limit") != "100" {
+		t.Errorf("path sharing the limit's prefix but not its segment was limited - %d %v", w.Code, w.Header())
+	}
+	if w = do("/api", "192.0.2.1:1234"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("the limit's own path was not limited - %d", w.Code)
+	}
+
+	// clients behind a trusted proxy are told apart by forwarded address
+	if w = do("/api/a", "10.0.0.1:1234", "X-Forwarded-For", "192.0.2.2"); w.Code != http.StatusOK {
+		t.Errorf("forwarded client was limited with another - %d", w.Code)
+	}
+	if w = do("/api/a", "10.0.0.2:1234", "X-Forwarded-For", "192.0.2.2"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("forwarded client was not limited through another proxy - %d", w.Code)
+	}
+
+	if w = do("/keyed/", "192.0.2.3:1234", "X-Api-Key", "one"); w.Code != http.StatusOK {
+		t.Errorf("first keyed request refused - %d", w.Code)
+	}
+	if w = do("/keyed/", "192.0.2.3:1234", "X-Api-Key", "two"); w.Code != http.StatusOK {
+		t.Errorf("different key from the same address was limited - %d", w.Code)
+	}
+	if w = do("/keyed/", "192.0.2.4:1234", "X-Api-Key", "one"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("same key from another address was not limited - %d", w.Code)
+	}
+
+	// alice:secret
+	if w = do("/users/", "192.0.2.5:1234", "Authorization", "Basic YWxpY2U6c2VjcmV0"); w.Code != http.StatusOK {
+		t.Errorf("first user request refused - %d", w.Code)
+	}
+	if w = do("/users/", "192.0.2.6:1234", "Authorization", "Basic YWxpY2U6c2VjcmV0"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("same user from another address was not limited - %d", w.Code)
+	}
+	// alice:wrong can't use up alice's allowance, or share one bucket
+	if w = do("/users/", "192.0.2.7:1234", "Authorization", "Basic YWxpY2U6d3Jvbmc="); w.Code != http.StatusOK {
+		t.Errorf("unverified user was limited as the verified one - %d", w.Code)
+	}
+	if w = do("/users/", "192.0.2.8:1234", "Authorization", "Basic YWxpY2U6d3Jvbmc="); w.Code != http.StatusOK {
+		t.Errorf("unverified user was limited by name rather than address - %d", w.Code)
+	}
+
+	// once its address is limited a client's passwords aren't checked at all
+	verified = 0
+	if w = do("/users/", "192.0.2.8:1234", "Authorization", "Basic YWxpY2U6d3Jvbmc="); w.Code != http.StatusTooManyRequests || verified != 0 {
+		t.Errorf("limited address had its credentials checked - %d, %d checks", w.Code, verified)
+	}
+}
+
+func TestRateLimitInvalid(t *testing.T) {
+	for _, conf := range []*RateLimit{
+		{},
+		{Requests: 1, Key: "cookie"},
+		{Requests: 1, Key: RateLimitHeader},
+	} {
+		if _, err := newLimiter(conf, middleware.TrustedProxies{}); err == nil {
+			t.Errorf("invalid rate limit %+v was accepted", conf)
+		}
+	}
+}
+
+func TestRateLimitVerifiedOnce(t *testing.T) {
+	auth := middleware.NewBasicAuth("alice", "secret")
+	rls, err := newRateLimits("test", []*RateLimit{{Requests: 10, Key: RateLimitUser}}, middleware.TrustedProxies{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rls.verify = auth.Verify
+
+	// the user verified by the limit is handed on, so it isn't verified again
+	// and the request comes back as it is
+	var user string
+	var again bool
+	h := rls.Chain(auth.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var checked *http.Request
+		checked, user, _ = auth.Verify(r)
+		again = checked != r
+	})))
+
+	r := httptest.NewRequest("GET", "http://example.com/", nil)
+	r.SetBasicAuth("alice", "secret")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || user != "alice" || again {
+		t.Errorf("verified user was not passed on - %d '%s'", w.Code, user)
+	}
+}
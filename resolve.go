@@ -0,0 +1,87 @@
+package liberty
+
+import (
+	"log"
+	"net"
+	"time"
+)
+
+// Resolver looks up the IP addresses of a remote host. A non zero TTL is used
+// as the time until the next lookup in place of the configured interval.
+type Resolver interface {
+	Resolve(host string) (ips []net.IP, ttl time.Duration, err error)
+}
+
+// systemResolver uses the operating system resolver, which does not report
+// TTLs, so lookups happen at the configured interval.
+type systemResolver struct{}
+
+func (systemResolver) Resolve(host string) ([]net.IP, time.Duration, error) {
+	ips, err := net.LookupIP(host)
+	return ips, 0, err
+}
+
+// DefaultResolver is used by proxies without a Resolver of their own
+var DefaultResolver Resolver = systemResolver{}
+
+const (
+	// defaultResolveInterval applies to a custom Resolver with no interval
+	defaultResolveInterval = 30 * time.Second
+
+	// minResolveInterval stops a resolver reporting tiny TTLs from spinning
+	minResolveInterval = time.Second
+)
+
+func tcpAddrs(ips []net.IP, port int) []*net.TCPAddr {
+	addrs := make([]*net.TCPAddr, len(ips))
+	for i, ip := range ips {
+		addrs[i] = &net.TCPAddr{IP: ip, Port: port}
+	}
+	return addrs
+}
+
+// resolveLoop keeps the members of a pool in step with the addresses of the
+// remote host. A failed or empty lookup keeps the last known good set.
+type resolveLoop struct {
+	resolver Resolver
+	host     string
+	port     int
+	interval time.Duration
+	pool     *pool
+}
+
+func (rl *resolveLoop) run() {
+	wait := rl.interval
+	for {
+		select {
+		case <-rl.pool.done:
+			return
+		case <-time.After(wait):
+		}
+
+		wait = rl.refresh()
+	}
+}
+
+// refresh looks up the remote host, updates the pool and returns the time to
+// wait until the next lookup
+func (rl *resolveLoop) refresh() time.Duration {
+	ips, ttl, err := rl.resolver.Resolve(rl.host)
+	switch {
+	case err != nil:
+		log.Printf("error in IP lookup for remote host '%s', keeping last known addresses - %s", rl.host, err)
+	case len(ips) == 0:
+		log.Printf("no IPs found for remote host '%s', keeping last known addresses", rl.host)
+	default:
+		rl.pool.update(tcpAddrs(ips, rl.port))
+	}
+
+	if ttl <= 0 {
+		ttl = rl.interval
+	}
+	if ttl < minResolveInterval {
+		ttl = minResolveInterval
+	}
+
+	return ttl
+}
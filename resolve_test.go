@@ -0,0 +1,66 @@
+package liberty
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+type testResolver struct {
+	ips []net.IP
+	ttl time.Duration
+	err error
+}
+
+func (tr *testResolver) Resolve(host string) ([]net.IP, time.Duration, error) {
+	return tr.ips, tr.ttl, tr.err
+}
+
+func memberAddrs(p *pool) map[string]bool {
+	addrs := map[string]bool{}
+	for _, m := range p.all() {
+		addrs[m.String()] = true
+	}
+	return addrs
+}
+
+func TestResolveUpdatesPool(t *testing.T) {
+	p, err := newPool("test", RoundRobin, nil, testAddrs(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := p.members[1]
+	p.members[0].acquire()
+
+	res := &testResolver{ips: []net.IP{net.IPv4(10, 0, 0, 2), net.IPv4(10, 0, 0, 3)}}
+	rl := &resolveLoop{resolver: res, host: "example.com", port: 80, interval: time.Minute, pool: p}
+
+	if wait := rl.refresh(); wait != time.Minute {
+		t.Errorf("expected the configured interval without a TTL, got %s", wait)
+	}
+
+	addrs := memberAddrs(p)
+	if len(addrs) != 2 || !addrs["10.0.0.2:80"] || !addrs["10.0.0.3:80"] {
+		t.Errorf("pool members not updated - %v", addrs)
+	}
+	if p.members[0] != kept {
+		t.Error("member for a remaining address was replaced")
+	}
+	if len(p.draining) != 1 || p.draining[0].String() != "10.0.0.1:80" {
+		t.Errorf("removed member with requests in flight is not draining - %v", p.draining)
+	}
+
+	// a failed lookup keeps the last known good addresses
+	res.err = errors.New("lookup failed")
+	rl.refresh()
+	if addrs := memberAddrs(p); len(addrs) != 2 {
+		t.Errorf("pool members changed after a failed lookup - %v", addrs)
+	}
+
+	res.err = nil
+	res.ttl = 5 * time.Second
+	if wait := rl.refresh(); wait != 5*time.Second {
+		t.Errorf("expected the resolver TTL, got %s", wait)
+	}
+}
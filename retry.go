@@ -0,0 +1,146 @@
+package liberty
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// Retry configures retrying a failed request against other members of the
+// upstream pool. A request which could not connect is retried whatever the
+// method, but a request which reached the upstream is only retried when the
+// method is idempotent and it failed or returned one of the listed statuses.
+//
+// Request bodies up to MaxBodyBytes are buffered so they can be replayed, a
+// larger body disables retries for that request. Budget is the ratio of
+// retries to requests allowed over time, so a struggling pool is not buried
+// under retries as well.
+type Retry struct {
+	Attempts     int     `yaml:"attempts"`
+	Statuses     []int   `yaml:"statuses, flow"`
+	MaxBodyBytes int64   `yaml:"maxBodyBytes"`
+	Budget       float64 `yaml:"budget"`
+}
+
+// set defaults for anything left out of the config
+func (rt *Retry) normalise() {
+	if rt.Attempts <= 0 {
+		rt.Attempts = 2
+	}
+	if rt.Statuses == nil {
+		rt.Statuses = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+	}
+	if rt.MaxBodyBytes <= 0 {
+		rt.MaxBodyBytes = 64 << 10
+	}
+	if rt.Budget <= 0 {
+		rt.Budget = 0.2
+	}
+}
+
+// retryReserve is the number of retries the budget allows in a burst
+const retryReserve = 10
+
+// retrier applies a retry policy and keeps track of its budget
+type retrier struct {
+	conf   *Retry
+	mu     sync.Mutex
+	tokens float64
+}
+
+func newRetrier(conf *Retry) *retrier {
+	conf.normalise()
+	return &retrier{conf: conf, tokens: retryReserve}
+}
+
+// deposit is called for every request, earning a fraction of a retry
+func (rt *retrier) deposit() {
+	rt.mu.Lock()
+	rt.tokens += rt.conf.Budget
+	if rt.tokens > retryReserve {
+		rt.tokens = retryReserve
+	}
+	rt.mu.Unlock()
+}
+
+// withdraw is called before every retry and fails if the budget is spent
+func (rt *retrier) withdraw() bool {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	if rt.tokens < 1 {
+		return false
+	}
+	rt.tokens--
+
+	return true
+}
+
+// buffer reads the request body into memory so it can be replayed. If the
+// body is too large it is left to stream and the request cannot be retried.
+func (rt *retrier) buffer(r *http.Request) (body []byte, ok bool, err error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true, nil
+	}
+	if r.ContentLength > rt.conf.MaxBodyBytes {
+		return nil, false, nil
+	}
+
+	body, err = ioutil.ReadAll(io.LimitReader(r.Body, rt.conf.MaxBodyBytes+1))
+	if err != nil {
+		return nil, false, err
+	}
+
+	if int64(len(body)) > rt.conf.MaxBodyBytes {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return nil, false, nil
+	}
+	r.Body.Close()
+
+	return body, true, nil
+}
+
+// should reports whether the outcome of an attempt may be retried
+func (rt *retrier) should(r *http.Request, resp *http.Response, err error, attempt int) bool {
+	if attempt > rt.conf.Attempts || r.Context().Err() != nil {
+		return false
+	}
+
+	if err != nil {
+		return isDialError(err) || idempotent(r.Method)
+	}
+
+	if !idempotent(r.Method) {
+		return false
+	}
+	for _, status := range rt.conf.Statuses {
+		if resp.StatusCode == status {
+			return true
+		}
+	}
+
+	return false
+}
+
+// a dial error means the request never left liberty so any method is safe to
+// send again
+func isDialError(err error) bool {
+	if op, ok := err.(*net.OpError); ok {
+		return op.Op == "dial"
+	}
+	return false
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
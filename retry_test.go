@@ -0,0 +1,99 @@
+package liberty
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRetryDialFailure(t *testing.T) {
+	live, stop := serverAddr(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	})
+	defer stop()
+
+	tr := testTransport(t, &Transport{retries: newRetrier(&Retry{})}, deadAddr(t), live)
+	req := httptest.NewRequest("POST", "http://example.com/", strings.NewReader("payload"))
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("request to dead upstream was not retried - %s", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if string(body) != "payload" {
+		t.Errorf("request body not replayed on retry, got '%s'", body)
+	}
+}
+
+func TestRetryStatus(t *testing.T) {
+	failing, stopFailing := serverAddr(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	defer stopFailing()
+	live, stopLive := serverAddr(t, func(w http.ResponseWriter, r *http.Request) {})
+	defer stopLive()
+
+	tests := []struct {
+		method   string
+		expected int
+	}{
+		{"GET", http.StatusOK},
+		{"PUT", http.StatusOK},
+		{"POST", http.StatusServiceUnavailable},
+	}
+
+	for _, test := range tests {
+		tr := testTransport(t, &Transport{retries: newRetrier(&Retry{})}, failing, live)
+		req := httptest.NewRequest(test.method, "http://example.com/", nil)
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != test.expected {
+			t.Errorf("%s - expected status %d, got %d", test.method, test.expected, resp.StatusCode)
+		}
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	rt := newRetrier(&Retry{Budget: 0.5})
+	for i := 0; i < retryReserve; i++ {
+		if !rt.withdraw() {
+			t.Fatalf("retry %d refused within the reserve", i)
+		}
+	}
+	if rt.withdraw() {
+		t.Fatal("retry allowed with the budget spent")
+	}
+
+	rt.deposit()
+	rt.deposit()
+	if !rt.withdraw() {
+		t.Error("retry refused after the budget was earned back")
+	}
+}
+
+func TestRetryLargeBody(t *testing.T) {
+	rt := newRetrier(&Retry{MaxBodyBytes: 4})
+	req := httptest.NewRequest("POST", "http://example.com/", strings.NewReader("too large"))
+	req.ContentLength = -1
+
+	body, ok, err := rt.buffer(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok || body != nil {
+		t.Error("large request body should not be replayable")
+	}
+
+	streamed, _ := ioutil.ReadAll(req.Body)
+	if string(streamed) != "too large" {
+		t.Errorf("large request body not streamed intact, got '%s'", streamed)
+	}
+}
@@ -1,12 +1,15 @@
 package liberty
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"golang.scot/liberty/middleware"
 
@@ -29,6 +32,58 @@ type ReverseProxy struct {
 	IPs           []string `yaml:"ips, flow"`
 	Cors          []string `yaml:"cors, flow"`
 	Servers       []*http.Server
+
+	// path rewriting applied before the request is forwarded
+	StripPrefix string         `yaml:"stripPrefix"`
+	AddPrefix   string         `yaml:"addPrefix"`
+	Rewrite     []*RewriteRule `yaml:"rewrite"`
+
+	// header rules applied to the forwarded request and to the response
+	RequestHeaders  *HeaderRules `yaml:"requestHeaders"`
+	ResponseHeaders *HeaderRules `yaml:"responseHeaders"`
+
+	// upstream pool balancing and connections, weights are keyed by remote IP
+	Balance          string            `yaml:"balance"`
+	Weights          map[string]int    `yaml:"weights"`
+	HealthCheck      *HealthCheck      `yaml:"healthCheck"`
+	OutlierDetection *OutlierDetection `yaml:"outlierDetection"`
+	Retry            *Retry            `yaml:"retry"`
+	Upstream         *Upstream         `yaml:"upstream"`
+
+	// how often the remote host is looked up again, a Resolver returning
+	// TTLs takes precedence over the interval
+	ResolveInterval time.Duration `yaml:"resolveInterval"`
+	Resolver        Resolver      `yaml:"-"`
+	remotePort      int
+
+	// client certificates verified for requests to this entry
+	ClientAuth *ClientAuth `yaml:"clientAuth"`
+
+	// limits on the rate of requests from each client, by path prefix
+	RateLimits []*RateLimit `yaml:"rateLimits"`
+
+	// ACME challenge types allowed for the host and its aliases, when left
+	// out the defaults from the ACME config apply
+	Challenges []string `yaml:"challenges, flow"`
+
+	// responses from the upstream are cached in memory when set
+	Cache *Cache `yaml:"cache"`
+	cache *responseCache
+
+	// rules for the responses from the upstream, such as Cache-Control
+	ResponseFilters []*ResponseFilter `yaml:"responseFilters"`
+
+	// responses are compressed for clients accepting it when set
+	Compression *Compression `yaml:"compression"`
+
+	// proxies in front of liberty whose forwarding headers are believed
+	trusted middleware.TrustedProxies
+
+	pool        *pool
+	upstreamTLS *tls.Config
+
+	// the addresses the entry is served on, true for those serving TLS
+	listeners map[string]bool
 }
 
 func (p *ReverseProxy) hostAndPath() (host string, path string) {
@@ -43,10 +98,14 @@ func (p *ReverseProxy) hostAndPath() (host string, path string) {
 }
 
 // Configure a proxy for use with the paramaters from the parsed yaml config. If
-// a remote host resolves to more than one IP address, we'll create a server and
-// for each. This works because under the hood we're using SO_REUSEPORT.
+// a remote host resolves to more than one IP address, each address becomes a
+// member of the upstream pool and requests are balanced between them using the
+// configured strategy.
 func (p *ReverseProxy) Configure(whitelist []*middleware.ApiWhitelist, router http.Handler) error {
 	p.normalise()
+	if err := validChallenges(p.Challenges); err != nil {
+		return err
+	}
 	if err := p.parseRemoteHost(); err != nil {
 		return err
 	}
@@ -105,67 +164,106 @@ func (p *ReverseProxy) parseRemoteHost() error {
 	}
 	p.remoteHostURL = remote
 
+	p.remotePort, err = strconv.Atoi(remotePort)
+	if err != nil {
+		return fmt.Errorf("cannot parse remote port '%s' - %s", remotePort, err)
+	}
+
 	// now lookup the IP addresses for this, we would typically expect the remote
 	// hose name to have one or more IP records in DNS or /etc/hosts
-	ips, err := net.LookupIP(remoteHost)
+	ips, _, err := p.resolver().Resolve(remoteHost)
 	if err != nil {
 		return fmt.Errorf("error in IP lookup for remote host '%s' - %s", remoteHost, err)
 	}
 
 	if p.remoteAddrs == nil {
-		addrs := make([]*net.TCPAddr, len(ips), len(ips))
-		for i, ip := range ips {
-			addr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("%s:%s", ip, remotePort))
-			if err != nil {
-				return fmt.Errorf("cannot parse address, port: '%s', port: %s, err: %s", ip, remotePort, err)
-			}
-			addrs[i] = addr
-		}
-		p.remoteAddrs = addrs
+		p.remoteAddrs = tcpAddrs(ips, p.remotePort)
 	}
 
 	return nil
 }
 
+func (p *ReverseProxy) resolver() Resolver {
+	if p.Resolver != nil {
+		return p.Resolver
+	}
+	return DefaultResolver
+}
+
 func (p *ReverseProxy) initServers(whitelist []*middleware.ApiWhitelist, router http.Handler) error {
-	s := &http.Server{
-		Addr: fmt.Sprintf("%s:80", p.HostIP),
+	pool, err := newPool(p.HostPath, p.Balance, p.Weights, p.remoteAddrs)
+	if err != nil {
+		return err
 	}
-	p.Servers = append(p.Servers, s)
+	p.pool = pool
 
-	for _, addr := range p.remoteAddrs {
-		s := &http.Server{
-			Addr: fmt.Sprintf("%s:%d", p.HostIP, p.HostPort),
-		}
+	if p.OutlierDetection != nil {
+		p.OutlierDetection.normalise()
+		pool.outlier = p.OutlierDetection
+	}
 
-		remoteShard := strings.Replace(p.RemoteHost, p.remoteHostURL.Host, addr.String(), 1)
-		err := reverseProxy(p, router, remoteShard, whitelist)
-		if err != nil {
-			return err
+	if p.Upstream == nil {
+		p.Upstream = &Upstream{}
+	}
+	p.Upstream.normalise()
+	if err := p.Upstream.validate(p.remoteHostURL.Scheme); err != nil {
+		return err
+	}
+	if p.upstreamTLS, err = p.Upstream.tlsConfig(p.remoteHostURL.Hostname()); err != nil {
+		return err
+	}
+
+	// the pool is only looked after once the entry is configured, so a failed
+	// entry leaves nothing running
+	if err := reverseProxy(p, router, whitelist); err != nil {
+		return err
+	}
+
+	if p.ResolveInterval > 0 || p.Resolver != nil {
+		if p.ResolveInterval <= 0 {
+			p.ResolveInterval = defaultResolveInterval
+		}
+		rl := &resolveLoop{
+			resolver: p.resolver(),
+			host:     p.remoteHostURL.Hostname(),
+			port:     p.remotePort,
+			interval: p.ResolveInterval,
+			pool:     pool,
 		}
+		go rl.run()
+	}
 
-		p.Servers = append(p.Servers, s)
+	if p.HealthCheck != nil {
+		hc := newHealthChecker(p.HealthCheck, pool, p.remoteHostURL.Scheme, p.remoteHostURL.Hostname(), p.upstreamTLS, p.Upstream)
+		go hc.run()
 	}
 
+	plain := fmt.Sprintf("%s:80", p.HostIP)
+	secure := fmt.Sprintf("%s:%d", p.HostIP, p.HostPort)
+	p.Servers = append(p.Servers, &http.Server{Addr: plain}, &http.Server{Addr: secure})
+	p.listeners = map[string]bool{plain: false, secure: true}
+
 	return nil
 }
 
 // build a chain of handlers, with the last one actually performing the reverse
 // proxy to the remote resource.
-func reverseProxy(p *ReverseProxy, handler http.Handler, remoteUrl string, whitelist []*middleware.ApiWhitelist) (err error) {
+func reverseProxy(p *ReverseProxy, handler http.Handler, whitelist []*middleware.ApiWhitelist) (err error) {
+	handlers := make([]middleware.Chainable, 0)
 
-	// if this remote host is not a valid resource we can't continue
-	remote, err := url.Parse(remoteUrl)
-	if err != nil {
-		return fmt.Errorf("cannot parse remote url '%s' - %s", remoteUrl, err)
+	// clients authenticating with a certificate are checked first
+	if p.ClientAuth != nil {
+		ca, err := newClientAuth(p.ClientAuth)
+		if err != nil {
+			return err
+		}
+		handlers = append(handlers, ca)
 	}
 
-	handlers := make([]middleware.Chainable, 0)
-
 	// next we check for restrictions based on location / IP
 	if len(p.IPs) > 0 {
 		nets := middleware.IPs2nets(p.IPs)
-		restricted := &middleware.IPRestrictedHandler{Allowed: nets}
+		restricted := &middleware.IPRestrictedHandler{Allowed: nets, Trusted: p.trusted}
 		restricted.HandlerType = p.HandlerType
 
 		// if this is also an API handler, pass in the open paths
@@ -178,18 +276,79 @@ func reverseProxy(p *ReverseProxy, handler http.Handler, remoteUrl string, white
 		handlers = append(handlers, restricted)
 	}
 
+	// then clients sending too many requests are turned away
+	if len(p.RateLimits) > 0 {
+		limits, err := newRateLimits(p.HostPath, p.RateLimits, p.trusted)
+		if err != nil {
+			return err
+		}
+		handlers = append(handlers, limits)
+	}
+
 	// use a standard library reverse proxy, but use our own transport so that
-	// we can further update the response
-	reverseProxy := httputil.NewSingleHostReverseProxy(remote)
-	reverseProxy.Transport = &Transport{
-		tr:   http.DefaultTransport,
-		tls:  p.Tls,
-		cors: p.Cors,
+	// we can pick the upstream address from the pool and further update the
+	// response
+	reverseProxy := httputil.NewSingleHostReverseProxy(p.remoteHostURL)
+
+	transport := &Transport{
+		tr:         p.Upstream.transport(p.upstreamTLS),
+		pool:       p.pool,
+		timeout:    p.Upstream.RequestTimeout,
+		clientAddr: p.Upstream.ProxyProtocol > 0,
+		http2:      p.Upstream.Protocol != HTTP1,
+		tls:        p.Tls,
+		cors:       p.Cors,
+		trusted:    p.trusted,
+	}
+	if p.Retry != nil {
+		transport.retries = newRetrier(p.Retry)
+	}
+	if p.RequestHeaders != nil {
+		if transport.requestHeaders, err = newHeaderRewriter(p.RequestHeaders, p.trusted); err != nil {
+			return err
+		}
+	}
+	if p.ResponseHeaders != nil {
+		if transport.responseHeaders, err = newHeaderRewriter(p.ResponseHeaders, p.trusted); err != nil {
+			return err
+		}
+	}
+	if p.Cache != nil {
+		p.cache = newResponseCache(p.Cache)
+		transport.cache = p.cache
+	}
+	if len(p.ResponseFilters) > 0 {
+		transport.filters = newResponseFilter(p.ResponseFilters)
+	}
+	if p.Compression != nil {
+		if transport.compress, err = newCompressor(p.Compression); err != nil {
+			return err
+		}
+	}
+	reverseProxy.Transport = transport
+	if transport.http2 {
+		reverseProxy.FlushInterval = streamFlushInterval
+	}
+
+	if p.StripPrefix != "" || p.AddPrefix != "" || len(p.Rewrite) > 0 {
+		rw, err := newRewriter(p.StripPrefix, p.AddPrefix, p.Rewrite)
+		if err != nil {
+			return err
+		}
+		director := reverseProxy.Director
+		reverseProxy.Director = func(r *http.Request) {
+			rw.rewrite(r)
+			director(r)
+		}
 	}
 
 	// wrap the reverse proxy in a hijacker that will handle any upgrades to
 	// websocket
-	reverse := middleware.WebsocketProxy(p.RemoteHost, reverseProxy)
+	var proxy http.Handler = reverseProxy
+	if p.cache != nil || transport.filters != nil {
+		proxy = withRequestURI(proxy)
+	}
+	reverse := middleware.WebsocketProxy(p.RemoteHost, p.upstreamTLS, proxy)
 
 	// now we should decided what type of resource the request is for, there's
 	// only really three basic types at the moment: web, api, metrics
@@ -200,7 +359,9 @@ func reverseProxy(p *ReverseProxy, handler http.Handler, remoteUrl string, white
 	case middleware.BasicAuthType:
 		final = middleware.BasicAuthHandler(reverse)
 	case middleware.ApiType:
-		handlers = append(handlers, middleware.NewApiHandler(whitelist))
+		api := middleware.NewApiHandler(whitelist)
+		api.Trusted = p.trusted
+		handlers = append(handlers, api)
 		final = middleware.BasicAuthHandler(reverse)
 	case middleware.GoGetType:
 		gg := &middleware.GoGet{Org: p.GoGetOrg}
@@ -1,8 +1,11 @@
 package liberty
 
 import (
+	"net/http"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestNormaliseProxy(t *testing.T) {
@@ -30,3 +33,26 @@ func TestNormaliseProxy(t *testing.T) {
 		t.Errorf("proxy not normalised - unepxected remote scheme %s, %#v", proxy.RemoteHost, proxy)
 	}
 }
+
+func TestConfigureFailureStartsNothing(t *testing.T) {
+	var checks int32
+	addr, stop := serverAddr(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&checks, 1)
+	})
+	defer stop()
+
+	proxy := &ReverseProxy{
+		HostPath:    "example.com",
+		RemoteHost:  addr.String(),
+		HealthCheck: &HealthCheck{Interval: 10 * time.Millisecond},
+		ClientAuth:  &ClientAuth{CAFile: "does-not-exist.pem"},
+	}
+	if err := proxy.Configure(nil, NewRouter()); err == nil {
+		t.Fatal("entry with a missing client CA was configured")
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&checks); n != 0 {
+		t.Errorf("health checks of an entry which failed to configure were made %d times", n)
+	}
+}
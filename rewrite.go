@@ -0,0 +1,102 @@
+package liberty
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// RewriteRule rewrites the path of a proxied request. Match is a regular
+// expression and Replace may refer to its capture groups as $1 or ${name}, and
+// to parameters matched by the router pattern as :name.
+type RewriteRule struct {
+	Match   string `yaml:"match"`
+	Replace string `yaml:"replace"`
+	re      *regexp.Regexp
+}
+
+var paramRef = regexp.MustCompile(`:[A-Za-z0-9_]+`)
+
+// rewriter changes the request path before it is forwarded. The prefix is
+// stripped first, then the first matching rule is applied and finally the new
+// prefix is added.
+type rewriter struct {
+	stripPrefix string
+	addPrefix   string
+	rules       []*RewriteRule
+}
+
+func newRewriter(stripPrefix, addPrefix string, rules []*RewriteRule) (*rewriter, error) {
+	for _, rule := range rules {
+		re, err := regexp.Compile(rule.Match)
+		if err != nil {
+			return nil, fmt.Errorf("cannot compile rewrite rule '%s' - %s", rule.Match, err)
+		}
+		rule.re = re
+	}
+
+	return &rewriter{
+		stripPrefix: strings.TrimSuffix(stripPrefix, "/"),
+		addPrefix:   strings.TrimSuffix(addPrefix, "/"),
+		rules:       rules,
+	}, nil
+}
+
+func (rw *rewriter) rewrite(r *http.Request) {
+	p := r.URL.Path
+
+	if rw.stripPrefix != "" && (p == rw.stripPrefix || strings.HasPrefix(p, rw.stripPrefix+"/")) {
+		p = strings.TrimPrefix(p, rw.stripPrefix)
+	}
+
+	for _, rule := range rw.rules {
+		match := rule.re.FindStringSubmatchIndex(p)
+		if match == nil {
+			continue
+		}
+
+		replace := rw.expandParams(r, rule.Replace)
+		p = p[:match[0]] + string(rule.re.ExpandString(nil, replace, p, match)) + p[match[1]:]
+		break
+	}
+
+	if rw.addPrefix != "" {
+		p = rw.addPrefix + "/" + strings.TrimPrefix(p, "/")
+	}
+
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	// keep a trailing slash, which path.Clean would otherwise remove
+	if clean := path.Clean(p); strings.HasSuffix(p, "/") && clean != "/" {
+		p = clean + "/"
+	} else {
+		p = clean
+	}
+
+	if p != r.URL.Path {
+		r.URL.Path = p
+		r.URL.RawPath = ""
+	}
+}
+
+// expandParams substitutes route parameters into a replacement, references to
+// parameters the route did not capture are left alone.
+func (rw *rewriter) expandParams(r *http.Request, replace string) string {
+	ctx := routingContext(r.Context())
+	if ctx == nil || len(ctx.Params) == 0 {
+		return replace
+	}
+
+	return paramRef.ReplaceAllStringFunc(replace, func(ref string) string {
+		for _, param := range ctx.Params {
+			if param.Key == ref[1:] {
+				// the result is expanded again for capture groups
+				return strings.Replace(param.Value, "$", "$$", -1)
+			}
+		}
+		return ref
+	})
+}
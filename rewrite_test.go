@@ -0,0 +1,61 @@
+package liberty
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+)
+
+var rewriteTests = []struct {
+	strip   string
+	add     string
+	rules   []*RewriteRule
+	params  Params
+	path    string
+	rewrite string
+}{
+	{"/api", "", nil, nil, "/api/users", "/users"},
+	{"/api", "", nil, nil, "/api", "/"},
+	{"/api/", "", nil, nil, "/api/users/", "/users/"},
+	{"/api", "", nil, nil, "/apiary", "/apiary"},
+	{"", "/v1", nil, nil, "/users", "/v1/users"},
+	{"/api", "/v2", nil, nil, "/api/users", "/v2/users"},
+	{"", "", []*RewriteRule{
+		{Match: `^/old/(.*)$`, Replace: "/new/$1"},
+	}, nil, "/old/page", "/new/page"},
+	{"", "", []*RewriteRule{
+		{Match: `^/(?P<lang>[a-z]{2})/(.*)$`, Replace: "/${lang}-$2"},
+	}, nil, "/en/about", "/en-about"},
+	{"", "", []*RewriteRule{
+		{Match: `^/users/.*$`, Replace: "/accounts/:id/profile"},
+	}, Params{{"id", "42"}}, "/users/42", "/accounts/42/profile"},
+	{"", "", []*RewriteRule{
+		{Match: `^/a/`, Replace: "/b/"},
+		{Match: `^/a/`, Replace: "/c/"},
+	}, nil, "/a/x", "/b/x"},
+}
+
+func TestRewrite(t *testing.T) {
+	for _, test := range rewriteTests {
+		rw, err := newRewriter(test.strip, test.add, test.rules)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := httptest.NewRequest("GET", "http://example.com"+test.path, nil)
+		if test.params != nil {
+			req = req.WithContext(context.WithValue(req.Context(), CtxKey, &Context{Params: test.params}))
+		}
+		rw.rewrite(req)
+
+		if req.URL.Path != test.rewrite {
+			t.Errorf("rewriting '%s' - expected '%s', got '%s'", test.path, test.rewrite, req.URL.Path)
+		}
+	}
+}
+
+func TestRewriteInvalidRule(t *testing.T) {
+	if _, err := newRewriter("", "", []*RewriteRule{{Match: "("}}); err == nil {
+		t.Error("expected an error for an invalid rewrite rule")
+	}
+}
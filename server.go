@@ -5,24 +5,34 @@ import (
 	"net"
 	"net/http"
 	"sort"
-	"strings"
 	"sync"
 	"sync/atomic"
 )
 
-const letsEncryptSandboxUrl = "https://acme-staging.api.letsencrypt.org/directory"
+// the Let's Encrypt ACME v2 directories, RFC 8555
+const (
+	letsEncryptUrl        = "https://acme-v02.api.letsencrypt.org/directory"
+	letsEncryptSandboxUrl = "https://acme-staging-v02.api.letsencrypt.org/directory"
+)
 
-// Crt defines a domain, certificate and keyfile
+// Crt defines a domain, certificate and keyfile. The domain may be a wildcard
+// such as "*.example.com", and if it is left out the names the certificate
+// was issued for are used. Changes to the files are picked up without a
+// restart.
 type Crt struct {
 	Domain   string
 	CertFile string
 	KeyFile  string
 }
 
+// server is a listening server, secure servers serve TLS and proxy requests
+// while the others answer ACME challenges and redirect to https
 type server struct {
-	open    uint32
-	s       *http.Server
-	handler http.Handler
+	open       uint32
+	s          *http.Server
+	handler    http.Handler
+	secure     bool
+	proxyProto *proxyProtocol
 }
 
 func (s *server) openConns() uint32 {
@@ -50,7 +60,9 @@ type ServerGroup struct {
 }
 
 // NewServerGroup creates a server group from a balancer and a slice of standard
-// library http servers
+// library http servers. The servers serve TLS and proxy requests through the
+// balancer, apart from those the balancer has been configured to serve plain
+// HTTP on.
 func NewServerGroup(balancer *Proxy, servers []*http.Server) *ServerGroup {
 	sg := &ServerGroup{
 		w:       &sync.Mutex{},
@@ -58,12 +70,14 @@ func NewServerGroup(balancer *Proxy, servers []*http.Server) *ServerGroup {
 	}
 
 	for _, s := range servers {
-		if !strings.HasSuffix(s.Addr, ":80") {
+		secure := balancer.serveTLS(s.Addr)
+		if secure {
 			s.Handler = balancer
 		}
 		srv := &server{
 			s:       s,
 			handler: s.Handler,
+			secure:  secure,
 		}
 
 		s.ConnState = srv.trackState
@@ -1,10 +1,28 @@
 package liberty
 
-import "testing"
+import (
+	"os"
+	"testing"
+
+	"golang.org/x/crypto/acme"
+)
 
 func TestAcmeDirectory(t *testing.T) {
-	client := newAcmeClient()
+	conf := &ACME{}
+	conf.normalise()
+	client, err := newAcmeClient(conf, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
 	if client.DirectoryURL != letsEncryptSandboxUrl {
 		t.Errorf("sandbox url for ACME not set")
 	}
+
+	os.Setenv("APP_ENV", "prod")
+	defer os.Unsetenv("APP_ENV")
+	conf = &ACME{}
+	conf.normalise()
+	if conf.DirectoryURL != acme.LetsEncryptURL {
+		t.Errorf("expected the ACME v2 directory %s, got %s", acme.LetsEncryptURL, conf.DirectoryURL)
+	}
 }
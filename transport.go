@@ -1,33 +1,313 @@
 package liberty
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
+
+	"golang.scot/liberty/middleware"
 )
 
+// how often streamed responses from HTTP/2 upstreams are flushed to the client
+const streamFlushInterval = 10 * time.Millisecond
+
 // Transport wraps a standard library http roundtripper
 type Transport struct {
-	tr   http.RoundTripper
-	tls  bool
-	cors []string
+	tr      http.RoundTripper
+	pool    *pool
+	retries *retrier
+	timeout time.Duration
+	tls     bool
+	cors    []string
+	trusted middleware.TrustedProxies
+
+	// pass the client address to the dialer for the PROXY protocol
+	clientAddr bool
+
+	// the upstream speaks HTTP/2, where bodies may be streams
+	http2 bool
+
+	// responses are kept for later requests
+	cache *responseCache
+
+	// rules for the responses from the upstream
+	filters *responseFilter
+
+	// responses are compressed for clients accepting it
+	compress *compressor
+
+	requestHeaders  *headerRewriter
+	responseHeaders *headerRewriter
 }
 
-// RoundTrip sets some standard headers
+// RoundTrip picks an upstream from the pool and sets some standard headers
 func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.setForwarded(r)
+	if t.requestHeaders != nil {
+		t.requestHeaders.apply(r.Header, r)
+	}
+
+	if t.clientAddr {
+		r = r.WithContext(withClientAddr(r.Context(), r.RemoteAddr))
+	}
+	if t.http2 {
+		// the reverse proxy drops TE as a hop by hop header, but gRPC needs
+		// it and trailers are passed back
+		r.Header.Set("Te", "trailers")
+	}
+
+	var resp *http.Response
+	var err error
+	if t.cache != nil {
+		resp, err = t.cache.roundTrip(r, t.upstream)
+	} else {
+		resp, err = t.upstream(r)
+	}
+	if err != nil {
+		return resp, err
+	}
+	if t.filters != nil {
+		t.filters.conditional(r, resp)
+	}
+	if t.compress != nil {
+		t.compress.apply(r, resp)
+	}
+
+	if t.cors != nil && len(t.cors) > 0 {
+		resp.Header.Set("Access-Control-Allow-Origin", strings.Join(t.cors, " "))
+	}
+	resp.Header.Set("Server", "Liberty")
+	resp.Header.Set("X-Frame-Options", "SAMEORIGIN")
+	// DANGER WILL ROBINSON
+	//resp.Header.Set("Strict-Transport-Security", "max-age=31536000; includeSubDomains")
+
+	if t.responseHeaders != nil {
+		t.responseHeaders.apply(resp.Header, r)
+	}
+
+	return resp, err
+}
+
+// upstream sends the request to the pool within the request timeout
+func (t *Transport) upstream(r *http.Request) (*http.Response, error) {
+	cancel := func() {}
+	if t.timeout > 0 {
+		var ctx context.Context
+		ctx, cancel = context.WithTimeout(r.Context(), t.timeout)
+		r = r.WithContext(ctx)
+	}
+
+	resp, err := t.send(r)
+	if err != nil {
+		cancel()
+		if r.Context().Err() == context.DeadlineExceeded {
+			return errorResponse(r, http.StatusGatewayTimeout), nil
+		}
+		return resp, err
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+
+	if t.filters != nil {
+		t.filters.apply(r, resp)
+	}
+
+	return resp, nil
+}
+
+// setForwarded adds this hop to the forwarding headers. Headers arriving from a
+// trusted proxy are extended, anything else is replaced so that a client can't
+// pass a forged address upstream. Only the header the trusted proxies maintain
+// is extended, the other is rebuilt from it so both carry the same chain.
+func (t *Transport) setForwarded(r *http.Request) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	peer := net.ParseIP(host)
+	if err != nil || peer == nil {
+		return
+	}
+	trusted := t.trusted.Contains(peer)
+
+	// the reverse proxy has already appended the peer to X-Forwarded-For
+	prior := r.Header.Get("X-Forwarded-For")
+	if prior == host {
+		prior = ""
+	}
+	prior = strings.TrimSuffix(prior, ", "+host)
+
+	if !trusted {
+		for _, h := range []string{"Forwarded", "X-Forwarded-Host", "X-Forwarded-Port", "X-Forwarded-Proto"} {
+			r.Header.Del(h)
+		}
+		prior = ""
+	}
+
 	// we're not really serving anything over port 80, so when we proxy always
 	// send https as the scheme in the forwarded headers
-	r.Header.Set("X-Forwarded-Proto", "https")
-	r.Header.Set("X-Forwarded-For", r.RemoteAddr)
+	element := fmt.Sprintf("for=%s;host=%q;proto=https", middleware.ForwardedNode(peer), r.Host)
+
+	var forwarded string
+	if t.trusted.Forwarded() {
+		forwarded = strings.Join(r.Header["Forwarded"], ", ")
+		nodes := make([]string, 0)
+		for _, ip := range middleware.ForwardedChain(r.Header) {
+			if ip == nil {
+				nodes = append(nodes, "unknown")
+			} else {
+				nodes = append(nodes, ip.String())
+			}
+		}
+		prior = strings.Join(nodes, ", ")
+	} else if prior != "" {
+		nodes := make([]string, 0)
+		for _, ip := range middleware.ForwardedForChain(http.Header{"X-Forwarded-For": {prior}}) {
+			nodes = append(nodes, "for="+middleware.ForwardedNode(ip))
+		}
+		forwarded = strings.Join(nodes, ", ")
+	}
+
+	if prior == "" {
+		r.Header.Set("X-Forwarded-For", host)
+	} else {
+		r.Header.Set("X-Forwarded-For", prior+", "+host)
+	}
+	if forwarded != "" {
+		element = forwarded + ", " + element
+	}
+	r.Header.Set("Forwarded", element)
+
+	if r.Header.Get("X-Forwarded-Host") == "" {
+		r.Header.Set("X-Forwarded-Host", r.Host)
+	}
+	if r.Header.Get("X-Forwarded-Port") == "" {
+		port := "443"
+		if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+			if _, p, err := net.SplitHostPort(addr.String()); err == nil {
+				port = p
+			}
+		}
+		r.Header.Set("X-Forwarded-Port", port)
+	}
+	if r.Header.Get("X-Forwarded-Proto") == "" {
+		r.Header.Set("X-Forwarded-Proto", "https")
+	}
+}
+
+// send the request to a member of the pool, retrying against a different
+// member each time when the retry policy allows it
+func (t *Transport) send(r *http.Request) (*http.Response, error) {
+	if t.pool == nil {
+		return t.tr.RoundTrip(r)
+	}
+
+	// with no member available the circuit is open, fail fast rather than
+	// waiting on an upstream we already know is broken
+	m := t.pool.next()
+	if m == nil {
+		return unavailable(r, t.pool.retryAfter()), nil
+	}
+
+	// a stream can't be buffered for retries without holding it up
+	if t.retries == nil || (t.http2 && r.ContentLength < 0) {
+		return t.attempt(r, m)
+	}
+
+	t.retries.deposit()
+	body, replayable, err := t.retries.buffer(r)
+	if err != nil {
+		return nil, err
+	}
+
+	tried := []*member{m}
+	for attempt := 1; ; attempt++ {
+		if body != nil {
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		resp, err := t.attempt(r, m)
+		if !replayable || !t.retries.should(r, resp, err, attempt) {
+			return resp, err
+		}
+
+		next := t.pool.next(tried...)
+		if next == nil || !t.retries.withdraw() {
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		m = next
+		tried = append(tried, m)
+	}
+}
+
+// attempt the request against a single member, recording the outcome for
+// outlier detection
+func (t *Transport) attempt(r *http.Request, m *member) (*http.Response, error) {
+	r.URL.Host = m.addr.String()
+	m.acquire()
 
 	resp, err := t.tr.RoundTrip(r)
-	if err == nil {
-		if t.cors != nil && len(t.cors) > 0 {
-			resp.Header.Set("Access-Control-Allow-Origin", strings.Join(t.cors, " "))
+	if err != nil {
+		m.release()
+		// a client going away says nothing about the upstream, but running
+		// out of time does
+		if r.Context().Err() != context.Canceled {
+			t.pool.report(m, true)
 		}
-		resp.Header.Set("Server", "Liberty")
-		resp.Header.Set("X-Frame-Options", "SAMEORIGIN")
-		// DANGER WILL ROBINSON
-		//resp.Header.Set("Strict-Transport-Security", "max-age=31536000; includeSubDomains")
+		return resp, err
 	}
-	return resp, err
+
+	t.pool.report(m, resp.StatusCode >= 500)
+	resp.Body = &releaseBody{ReadCloser: resp.Body, m: m}
+
+	return resp, nil
+}
+
+// cancelBody releases the request context once the response body is done
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// errorResponse builds a plain text response for errors liberty generates
+// itself rather than relaying from an upstream
+func errorResponse(r *http.Request, code int) *http.Response {
+	body := http.StatusText(code) + "\n"
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		StatusCode: code,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Content-Type": {"text/plain; charset=utf-8"},
+			"Server":       {"Liberty"},
+		},
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       r,
+	}
+}
+
+// unavailable is the response when an upstream pool has no members to take
+// the request, retry after is rounded up to whole seconds
+func unavailable(r *http.Request, retryAfter time.Duration) *http.Response {
+	resp := errorResponse(r, http.StatusServiceUnavailable)
+	secs := int((retryAfter + time.Second - 1) / time.Second)
+	resp.Header.Set("Retry-After", strconv.Itoa(secs))
+	return resp
 }
@@ -0,0 +1,43 @@
+package liberty
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func serverAddr(t *testing.T, h http.HandlerFunc) (*net.TCPAddr, func()) {
+	server := httptest.NewServer(h)
+	u, _ := url.Parse(server.URL)
+	addr, err := net.ResolveTCPAddr("tcp", u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return addr, server.Close
+}
+
+func deadAddr(t *testing.T) *net.TCPAddr {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+	return ln.Addr().(*net.TCPAddr)
+}
+
+// testTransport sends requests to a pool of the addresses through tr, which
+// carries the options under test, with the default round tripper unless it
+// has one of its own
+func testTransport(t *testing.T, tr *Transport, addrs ...*net.TCPAddr) *Transport {
+	p, err := newPool("test", RoundRobin, nil, addrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.pool = p
+	if tr.tr == nil {
+		tr.tr = http.DefaultTransport
+	}
+	return tr
+}
@@ -0,0 +1,336 @@
+package liberty
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// Upstream configures the connections liberty makes to the members of an
+// upstream pool, each proxy entry gets a transport of its own.
+type Upstream struct {
+	// timeouts for each stage of the exchange, RequestTimeout bounds all of
+	// it including retries and the response body and is off unless set, so
+	// streamed responses aren't cut off. A request exceeding it gets a 504.
+	DialTimeout           time.Duration `yaml:"dialTimeout"`
+	TLSHandshakeTimeout   time.Duration `yaml:"tlsHandshakeTimeout"`
+	ResponseHeaderTimeout time.Duration `yaml:"responseHeaderTimeout"`
+	IdleConnTimeout       time.Duration `yaml:"idleConnTimeout"`
+	RequestTimeout        time.Duration `yaml:"requestTimeout"`
+
+	// limits on the connections kept idle and open at once, zero MaxConns
+	// meaning no limit. Idle connections count towards MaxConns and are
+	// closed when a new one is needed. HTTP/2 upstreams can't be limited.
+	MaxIdleConns        int `yaml:"maxIdleConns"`
+	MaxIdleConnsPerHost int `yaml:"maxIdleConnsPerHost"`
+	MaxConns            int `yaml:"maxConns"`
+
+	// PROXY protocol version, 1 or 2, sent with the client address on each
+	// connection, which is then not kept alive. Websockets don't send it.
+	ProxyProtocol int `yaml:"proxyProtocol"`
+
+	// TLS connections to an https upstream, verified against the remote host
+	// name rather than the addresses of the pool members
+	TLS *UpstreamTLS `yaml:"tls"`
+
+	// "http1", the default, "h2" over TLS or "h2c" over plain TCP as used by
+	// gRPC. HTTP/2 streams bodies both ways and passes on trailers, but a
+	// streamed request can't be retried and the header and idle limits don't
+	// apply.
+	Protocol string `yaml:"protocol"`
+}
+
+// upstream protocols
+const (
+	HTTP1 = "http1"
+	H2    = "h2"
+	H2C   = "h2c"
+)
+
+// UpstreamTLS configures the TLS connections to an upstream. CAFile is a PEM
+// bundle of the CAs to trust in place of the system roots, ServerName is the
+// name to verify the upstream certificate against if it isn't the remote host
+// and CertFile and KeyFile are a client certificate to present. MinVersion is
+// one of "1.0", "1.1", "1.2" or "1.3". InsecureSkipVerify turns verification off
+// altogether and is only for testing.
+type UpstreamTLS struct {
+	CAFile             string `yaml:"caFile"`
+	ServerName         string `yaml:"serverName"`
+	CertFile           string `yaml:"certFile"`
+	KeyFile            string `yaml:"keyFile"`
+	MinVersion         string `yaml:"minVersion"`
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// set defaults for anything left out of the config, these follow the standard
+// library default transport apart from allowing more idle connections per
+// host, as every request from the proxy goes to the same few hosts, and
+// giving up on an upstream which doesn't send response headers.
+func (u *Upstream) normalise() {
+	if u.DialTimeout <= 0 {
+		u.DialTimeout = 30 * time.Second
+	}
+	if u.TLSHandshakeTimeout <= 0 {
+		u.TLSHandshakeTimeout = 10 * time.Second
+	}
+	if u.IdleConnTimeout <= 0 {
+		u.IdleConnTimeout = 90 * time.Second
+	}
+	if u.ResponseHeaderTimeout <= 0 {
+		u.ResponseHeaderTimeout = 60 * time.Second
+	}
+	if u.MaxIdleConns <= 0 {
+		u.MaxIdleConns = 100
+	}
+	if u.MaxIdleConnsPerHost <= 0 {
+		u.MaxIdleConnsPerHost = 16
+	}
+	if u.MaxConns > 0 && u.MaxIdleConns > u.MaxConns {
+		u.MaxIdleConns = u.MaxConns
+	}
+	if u.MaxConns > 0 && u.MaxIdleConnsPerHost > u.MaxConns {
+		u.MaxIdleConnsPerHost = u.MaxConns
+	}
+	if u.Protocol == "" {
+		u.Protocol = HTTP1
+	}
+}
+
+// validate the options which normalise can't choose a default for, against
+// the scheme of the remote host
+func (u *Upstream) validate(scheme string) error {
+	if u.ProxyProtocol < 0 || u.ProxyProtocol > 2 {
+		return fmt.Errorf("unknown PROXY protocol version %d", u.ProxyProtocol)
+	}
+
+	switch u.Protocol {
+	case HTTP1:
+	case H2, H2C:
+		if (u.Protocol == H2) != (scheme == "https") {
+			return fmt.Errorf("upstream protocol '%s' cannot be used with %s", u.Protocol, scheme)
+		}
+		// HTTP/2 connections are shared between clients
+		if u.ProxyProtocol > 0 {
+			return fmt.Errorf("upstream protocol '%s' cannot send the PROXY protocol", u.Protocol)
+		}
+		// a dial waiting for the limit would outlive the request
+		if u.MaxConns > 0 {
+			return fmt.Errorf("upstream protocol '%s' cannot be used with maxConns", u.Protocol)
+		}
+	default:
+		return fmt.Errorf("unknown upstream protocol '%s'", u.Protocol)
+	}
+
+	return nil
+}
+
+// tlsConfig builds the client TLS config for connections to the upstream, by
+// default verifying its certificate against the remote host.
+func (u *Upstream) tlsConfig(host string) (*tls.Config, error) {
+	config := &tls.Config{ServerName: host}
+	if u.TLS == nil {
+		return config, nil
+	}
+
+	if u.TLS.ServerName != "" {
+		config.ServerName = u.TLS.ServerName
+	}
+
+	if u.TLS.CAFile != "" {
+		pem, err := ioutil.ReadFile(u.TLS.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in '%s'", u.TLS.CAFile)
+		}
+	}
+
+	if u.TLS.CertFile != "" || u.TLS.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(u.TLS.CertFile, u.TLS.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if u.TLS.MinVersion != "" {
+		version, ok := tlsVersions[u.TLS.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version '%s'", u.TLS.MinVersion)
+		}
+		config.MinVersion = version
+	}
+
+	if u.TLS.InsecureSkipVerify {
+		log.Printf("WARNING: certificates of the upstream '%s' are NOT verified, connections to it can be intercepted", host)
+		config.InsecureSkipVerify = true
+	}
+
+	return config, nil
+}
+
+// dialer builds the dial function for connections to the upstream
+func (u *Upstream) dialer() dialFunc {
+	dialer := &net.Dialer{
+		Timeout:   u.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	dial := dialer.DialContext
+	if u.ProxyProtocol > 0 {
+		dial = proxyProtocolDialer(u.ProxyProtocol, dial)
+	}
+
+	return dial
+}
+
+// transport builds the round tripper for the upstream protocol
+func (u *Upstream) transport(tlsConfig *tls.Config) http.RoundTripper {
+	dial := u.dialer()
+	var limiter *connLimiter
+	if u.MaxConns > 0 {
+		limiter = newConnLimiter(u.MaxConns)
+		dial = limiter.wrap(dial)
+	}
+
+	switch u.Protocol {
+	case H2:
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.NextProtos = []string{http2.NextProtoTLS}
+		return &http2.Transport{
+			TLSClientConfig: tlsConfig,
+			DialTLS: func(network, addr string, config *tls.Config) (net.Conn, error) {
+				return dialH2(dial, network, addr, config, u.TLSHandshakeTimeout)
+			},
+		}
+	case H2C:
+		return &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dial(context.Background(), network, addr)
+			},
+		}
+	}
+
+	t := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dial,
+		TLSClientConfig:       tlsConfig,
+		MaxIdleConns:          u.MaxIdleConns,
+		MaxIdleConnsPerHost:   u.MaxIdleConnsPerHost,
+		IdleConnTimeout:       u.IdleConnTimeout,
+		TLSHandshakeTimeout:   u.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: u.ResponseHeaderTimeout,
+		ExpectContinueTimeout: 1 * time.Second,
+		DisableKeepAlives:     u.ProxyProtocol > 0,
+	}
+	if limiter != nil {
+		limiter.closeIdle = t.CloseIdleConnections
+	}
+
+	return t
+}
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// dialH2 makes a TLS connection to an HTTP/2 upstream, which has to agree to
+// speak HTTP/2
+func dialH2(dial dialFunc, network, addr string, config *tls.Config, timeout time.Duration) (net.Conn, error) {
+	conn, err := dial(context.Background(), network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConn := tls.Client(conn, config)
+	tlsConn.SetDeadline(time.Now().Add(timeout))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	if proto := tlsConn.ConnectionState().NegotiatedProtocol; proto != http2.NextProtoTLS {
+		conn.Close()
+		return nil, fmt.Errorf("upstream %s does not support HTTP/2", addr)
+	}
+
+	return tlsConn, nil
+}
+
+// connLimiter caps the number of connections open at once, a dial waits for
+// a connection to close or for its context to be done. Idle connections hold
+// on to their slots, so a dial which has to wait closes them once.
+type connLimiter struct {
+	slots     chan struct{}
+	closeIdle func()
+}
+
+func newConnLimiter(max int) *connLimiter {
+	return &connLimiter{slots: make(chan struct{}, max)}
+}
+
+func (l *connLimiter) wrap(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if err := l.acquire(ctx); err != nil {
+			return nil, err
+		}
+
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			<-l.slots
+			return nil, err
+		}
+
+		return &limitedConn{Conn: conn, limiter: l}, nil
+	}
+}
+
+func (l *connLimiter) acquire(ctx context.Context) error {
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	if l.closeIdle != nil {
+		l.closeIdle()
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type limitedConn struct {
+	net.Conn
+	limiter *connLimiter
+	once    sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(func() { <-c.limiter.slots })
+	return c.Conn.Close()
+}
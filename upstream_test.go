@@ -0,0 +1,369 @@
+package liberty
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+func TestRequestTimeout(t *testing.T) {
+	done := make(chan struct{})
+	slow, stop := serverAddr(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+		}
+	})
+	defer stop()
+	defer close(done)
+
+	u := &Upstream{RequestTimeout: 50 * time.Millisecond}
+	u.normalise()
+	tr := testTransport(t, &Transport{tr: u.transport(nil), timeout: u.RequestTimeout}, slow)
+
+	resp, err := tr.RoundTrip(httptest.NewRequest("GET", "http://example.com/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("expected status 504, got %d", resp.StatusCode)
+	}
+}
+
+func TestStreamNotTimedOut(t *testing.T) {
+	upstream, stop := serverAddr(t, func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 5; i++ {
+			w.Write([]byte("chunk\n"))
+			w.(http.Flusher).Flush()
+			time.Sleep(40 * time.Millisecond)
+		}
+	})
+	defer stop()
+
+	u := &Upstream{ResponseHeaderTimeout: 50 * time.Millisecond}
+	u.normalise()
+	if u.RequestTimeout != 0 {
+		t.Errorf("request timeout defaulted to %s", u.RequestTimeout)
+	}
+	tr := testTransport(t, &Transport{tr: u.transport(nil), timeout: u.RequestTimeout}, upstream)
+
+	resp, err := tr.RoundTrip(httptest.NewRequest("GET", "http://example.com/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil || len(body) != 5*len("chunk\n") {
+		t.Errorf("body streamed past the header timeout was cut off after %d bytes - %v", len(body), err)
+	}
+}
+
+func TestConnLimiter(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			if _, err := ln.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+
+	closed := 0
+	limiter := newConnLimiter(1)
+	limiter.closeIdle = func() { closed++ }
+	dial := limiter.wrap((&net.Dialer{}).DialContext)
+	conn, err := dial(context.Background(), "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+	if _, err := dial(ctx, "tcp", ln.Addr().String()); err == nil {
+		t.Fatal("dial succeeded beyond the connection limit")
+	}
+	// the idle connections are closed once, not over and over while it waits
+	if closed != 1 {
+		t.Errorf("expected idle connections to be closed once, got %d", closed)
+	}
+
+	conn.Close()
+	conn, err = dial(context.Background(), "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial failed after a connection was closed - %s", err)
+	}
+	conn.Close()
+}
+
+func TestConnLimiterIdleConns(t *testing.T) {
+	var addrs []*net.TCPAddr
+	for i := 0; i < 2; i++ {
+		addr, stop := serverAddr(t, func(w http.ResponseWriter, r *http.Request) {})
+		defer stop()
+		addrs = append(addrs, addr)
+	}
+
+	u := &Upstream{MaxConns: 1, RequestTimeout: 2 * time.Second}
+	u.normalise()
+	if u.MaxIdleConns != 1 || u.MaxIdleConnsPerHost != 1 {
+		t.Errorf("idle connection limits were not capped at MaxConns, got %d and %d", u.MaxIdleConns, u.MaxIdleConnsPerHost)
+	}
+	tr := testTransport(t, &Transport{tr: u.transport(nil), timeout: u.RequestTimeout}, addrs...)
+
+	// the keep alive connection to the first member mustn't keep the second
+	// from being dialled
+	for i := 0; i < 4; i++ {
+		resp, err := tr.RoundTrip(httptest.NewRequest("GET", "http://example.com/", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d got status %d", i, resp.StatusCode)
+		}
+	}
+}
+
+func TestUpstreamTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	addr := srv.Listener.Addr().(*net.TCPAddr)
+
+	dir, err := ioutil.TempDir("", "liberty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	caPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, caPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host string
+		conf *UpstreamTLS
+		ok   bool
+	}{
+		// the test certificate is for example.com, which isn't in the system roots
+		{"example.com", nil, false},
+		{"example.com", &UpstreamTLS{CAFile: caFile}, true},
+		{"liberty.example.org", &UpstreamTLS{CAFile: caFile}, false},
+		{"liberty.example.org", &UpstreamTLS{CAFile: caFile, ServerName: "example.com"}, true},
+		{"liberty.example.org", &UpstreamTLS{InsecureSkipVerify: true}, true},
+	}
+
+	for i, test := range tests {
+		u := &Upstream{TLS: test.conf}
+		u.normalise()
+		tlsConfig, err := u.tlsConfig(test.host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr := testTransport(t, &Transport{tr: u.transport(tlsConfig)}, addr)
+
+		resp, err := tr.RoundTrip(httptest.NewRequest("GET", "https://"+test.host+"/", nil))
+		ok := err == nil && resp.StatusCode == http.StatusOK
+		if ok != test.ok {
+			t.Errorf("test %d - expected success to be %t, got %t (%v)", i, test.ok, ok, err)
+		}
+	}
+
+	u := &Upstream{TLS: &UpstreamTLS{MinVersion: "0.9"}}
+	if _, err := u.tlsConfig("example.com"); err == nil {
+		t.Error("expected an error for an unknown TLS version")
+	}
+	u = &Upstream{TLS: &UpstreamTLS{MinVersion: "1.3"}}
+	if config, err := u.tlsConfig("example.com"); err != nil || config.MinVersion != tls.VersionTLS13 {
+		t.Errorf("TLS 1.3 was not accepted as the minimum version - %v", err)
+	}
+}
+
+// serveH2C serves HTTP/2 with prior knowledge over plain TCP, as a gRPC
+// server does
+func serveH2C(t *testing.T, h http.Handler) (*net.TCPAddr, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		srv := &http2.Server{}
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go srv.ServeConn(conn, &http2.ServeConnOpts{Handler: h})
+		}
+	}()
+
+	return ln.Addr().(*net.TCPAddr), func() { ln.Close() }
+}
+
+// grpcEcho writes back each message as it arrives, then ends the stream with
+// a status trailer which wasn't announced up front
+func grpcEcho(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Te") != "trailers" {
+		http.Error(w, "missing TE: trailers", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/grpc")
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+
+	buf := make([]byte, 1024)
+	for {
+		n, err := r.Body.Read(buf)
+		if n > 0 {
+			w.Write(buf[:n])
+			w.(http.Flusher).Flush()
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+}
+
+func TestH2CStreaming(t *testing.T) {
+	upstream, stop := serveH2C(t, http.HandlerFunc(grpcEcho))
+	defer stop()
+
+	u := &Upstream{Protocol: H2C, RequestTimeout: 5 * time.Second}
+	u.normalise()
+	if err := u.validate("http"); err != nil {
+		t.Fatal(err)
+	}
+
+	target, _ := url.Parse("http://grpc.example.com")
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = testTransport(t, &Transport{
+		tr:      u.transport(nil),
+		timeout: u.RequestTimeout,
+		retries: newRetrier(&Retry{}),
+		http2:   true,
+	}, upstream)
+	proxy.FlushInterval = streamFlushInterval
+
+	// the client talks HTTP/2 to liberty as well, so both directions stream
+	front, stopFront := serveH2C(t, proxy)
+	defer stopFront()
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+
+	body, send := io.Pipe()
+	req, _ := http.NewRequest("POST", "http://"+front.String()+"/echo.Echo/Stream", body)
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.StatusCode)
+	}
+
+	// each message comes back before the next is sent
+	buf := make([]byte, 1024)
+	for _, msg := range []string{"ping 1", "ping 2", "ping 3"} {
+		if _, err := send.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		n, err := io.ReadAtLeast(resp.Body, buf, len(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != msg {
+			t.Errorf("expected echo '%s', got '%s'", msg, buf[:n])
+		}
+	}
+	send.Close()
+
+	if _, err := ioutil.ReadAll(resp.Body); err != nil {
+		t.Fatal(err)
+	}
+	if status := resp.Trailer.Get("Grpc-Status"); status != "0" {
+		t.Errorf("expected trailer Grpc-Status 0, got '%s'", status)
+	}
+}
+
+func TestUpstreamProtocol(t *testing.T) {
+	tests := []struct {
+		u      Upstream
+		scheme string
+		ok     bool
+	}{
+		{Upstream{}, "http", true},
+		{Upstream{Protocol: H2}, "https", true},
+		{Upstream{Protocol: H2}, "http", false},
+		{Upstream{Protocol: H2C}, "http", true},
+		{Upstream{Protocol: H2C}, "https", false},
+		{Upstream{Protocol: H2C, ProxyProtocol: 1}, "http", false},
+		{Upstream{Protocol: H2, MaxConns: 10}, "https", false},
+		{Upstream{Protocol: H2C, MaxConns: 10}, "http", false},
+		{Upstream{MaxConns: 10}, "http", true},
+		{Upstream{Protocol: "spdy"}, "https", false},
+	}
+
+	for i, test := range tests {
+		test.u.normalise()
+		if err := test.u.validate(test.scheme); (err == nil) != test.ok {
+			t.Errorf("test %d - expected valid to be %t, got %v", i, test.ok, err)
+		}
+	}
+}
+
+func TestH2Upstream(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+	if err := http2.ConfigureServer(srv.Config, nil); err != nil {
+		t.Fatal(err)
+	}
+	srv.TLS = srv.Config.TLSConfig
+	srv.StartTLS()
+	defer srv.Close()
+
+	u := &Upstream{Protocol: H2}
+	u.normalise()
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	tr := testTransport(t, &Transport{tr: u.transport(&tls.Config{ServerName: "example.com", RootCAs: roots}), http2: true}, srv.Listener.Addr().(*net.TCPAddr))
+
+	resp, err := tr.RoundTrip(httptest.NewRequest("GET", "https://example.com/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proto, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(proto) != "HTTP/2.0" {
+		t.Errorf("expected the upstream to see HTTP/2.0, got %s", proto)
+	}
+}